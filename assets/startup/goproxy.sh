@@ -46,9 +46,15 @@ restart() {
     start
 }
 
+upgrade() {
+    echo -n "Upgrading ${PACKAGE_DESC}: "
+    kill -USR2 `cat /var/run/goproxy.pid` >/dev/null 2>&1 || true
+    echo "${PACKAGE_NAME}."
+}
+
 usage() {
     N=$(basename "$0")
-    echo "Usage: [sudo] $N {start|stop|reload|restart}" >&2
+    echo "Usage: [sudo] $N {start|stop|reload|restart|upgrade}" >&2
     exit 1
 }
 
@@ -73,6 +79,9 @@ case "$1" in
     restart)
         restart
         ;;
+    upgrade)
+        upgrade
+        ;;
     *)
         usage
         ;;
@@ -0,0 +1,244 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	AccessLogCommon   = "common"
+	AccessLogCombined = "combined"
+	AccessLogJSON     = "json"
+)
+
+type AccessLogEntry struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	User      string    `json:"user,omitempty"`
+	Method    string    `json:"method"`
+	URL       string    `json:"url"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	BytesIn   int64     `json:"bytes_in"`
+	BytesOut  int64     `json:"bytes_out"`
+	Duration  float64   `json:"duration"`
+	Filter    string    `json:"filter,omitempty"`
+	Route     string    `json:"route,omitempty"`
+	Upstream  string    `json:"upstream,omitempty"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// AccessLog writes one line per request in Format to Output, lines go to
+// glog if Output is nil.
+type AccessLog struct {
+	Format string
+	Output io.Writer
+	mu     sync.Mutex
+}
+
+func NewAccessLog(format string, output io.Writer) (*AccessLog, error) {
+	switch format {
+	case "":
+		format = AccessLogCommon
+	case AccessLogCommon, AccessLogCombined, AccessLogJSON:
+	default:
+		return nil, fmt.Errorf("unknown access log format %#v", format)
+	}
+
+	return &AccessLog{
+		Format: format,
+		Output: output,
+	}, nil
+}
+
+func (l *AccessLog) Log(e *AccessLogEntry) {
+	var line string
+	switch l.Format {
+	case AccessLogJSON:
+		b, err := json.Marshal(e)
+		if err != nil {
+			glog.Errorf("json.Marshal(%#v) error: %v", e, err)
+			return
+		}
+		line = string(b)
+	default:
+		host := e.Client
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		line = fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %d",
+			host, dash(e.User), e.Time.Format("02/Jan/2006:15:04:05 -0700"), e.Method, e.URL, e.Proto, e.Status, e.BytesOut)
+		if l.Format == AccessLogCombined {
+			line += fmt.Sprintf(" %q %q", dash(e.Referer), dash(e.UserAgent))
+		}
+		line += fmt.Sprintf(" %s %s %d %.3f %q", dash(e.Filter), dash(e.Upstream), e.BytesIn, e.Duration, dash(e.Error))
+	}
+
+	if l.Output == nil {
+		glog.Info(line)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := io.WriteString(l.Output, line+"\n"); err != nil {
+		glog.Errorf("AccessLog write error: %v", err)
+	}
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// countingResponseWriter counts the bytes and records the status written to
+// clients, including connections hijacked from it.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status   int
+	bytesIn  int64
+	bytesOut int64
+	hijacked bool
+	onHijack func(net.Conn)
+}
+
+func (rw *countingResponseWriter) WriteHeader(code int) {
+	if rw.status == 0 {
+		rw.status = code
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *countingResponseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	atomic.AddInt64(&rw.bytesOut, int64(n))
+	return n, err
+}
+
+func (rw *countingResponseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rw *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("http.ResponseWriter(%#v) does not implments http.Hijacker", rw.ResponseWriter)
+	}
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	rw.hijacked = true
+
+	var c net.Conn = &countingConn{Conn: conn, rw: rw}
+	if brw != nil {
+		if n := brw.Reader.Buffered(); n > 0 {
+			data, _ := brw.Reader.Peek(n)
+			atomic.AddInt64(&rw.bytesIn, int64(n))
+			c = &prefixConn{Conn: c, prefix: append([]byte(nil), data...)}
+		}
+		brw = bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c))
+	}
+	if rw.onHijack != nil {
+		rw.onHijack(c)
+	}
+	return c, brw, nil
+}
+
+func (rw *countingResponseWriter) Status() int {
+	if rw.status == 0 {
+		return http.StatusOK
+	}
+	return rw.status
+}
+
+type countingConn struct {
+	net.Conn
+	rw *countingResponseWriter
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.rw.bytesIn, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	if c.rw.status == 0 && len(b) >= 12 && bytes.HasPrefix(b, []byte("HTTP/1.")) {
+		c.rw.status, _ = strconv.Atoi(string(b[9:12]))
+	}
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.rw.bytesOut, int64(n))
+	return n, err
+}
+
+func (c *countingConn) unwrapRead() (net.Conn, []byte, *int64) {
+	return c.Conn, nil, &c.rw.bytesIn
+}
+
+func (c *countingConn) unwrapWrite() (net.Conn, *int64) {
+	return c.Conn, &c.rw.bytesOut
+}
+
+// NewPrefixConn returns c which reads prefix first, e.g. the bytes read ahead
+// by a handshake, Relay still splices the underlying conn.
+func NewPrefixConn(c net.Conn, prefix []byte) net.Conn {
+	return &prefixConn{Conn: c, prefix: prefix}
+}
+
+// prefixConn replays prefix before reading from Conn.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *prefixConn) unwrapRead() (net.Conn, []byte, *int64) {
+	data := c.prefix
+	c.prefix = nil
+	return c.Conn, data, nil
+}
+
+func (c *prefixConn) unwrapWrite() (net.Conn, *int64) {
+	return c.Conn, nil
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (r *countingReadCloser) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
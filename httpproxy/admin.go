@@ -0,0 +1,295 @@
+package httpproxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"./filters"
+	"./metrics"
+)
+
+// AdminFilter is implemented by filters with runtime state, the admin API
+// passes requests under /filters/<name>/ to ServeAdmin with the prefix stripped.
+type AdminFilter interface {
+	ServeAdmin(rw http.ResponseWriter, req *http.Request)
+}
+
+// HostFilter is implemented by filters picking requests by host, MatchHost
+// returns the decision of each of their host lists, nil if not matched.
+type HostFilter interface {
+	MatchHost(host string) map[string]interface{}
+}
+
+// Admin serves metrics and the admin API of Handlers and their ConnTable, all
+// but /metrics require the basic auth Username and Password and are disabled
+// without a Password.
+type Admin struct {
+	Handlers []*Handler
+	Conns    *ConnTable
+	Username string
+	Password string
+	mux      *http.ServeMux
+}
+
+func NewAdmin(handlers []*Handler, conns *ConnTable, username, password string) *Admin {
+	a := &Admin{
+		Handlers: handlers,
+		Conns:    conns,
+		Username: username,
+		Password: password,
+		mux:      http.NewServeMux(),
+	}
+
+	a.mux.Handle("/metrics", metrics.Handler())
+	a.mux.HandleFunc("/filters", a.serveFilters)
+	a.mux.HandleFunc("/filters/", a.serveFilter)
+	a.mux.HandleFunc("/hosts", a.serveHosts)
+	a.mux.HandleFunc("/conns", a.serveConns)
+	a.mux.HandleFunc("/conns/", a.serveConns)
+
+	return a
+}
+
+func (a *Admin) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/metrics" {
+		if a.Password == "" {
+			http.Error(rw, "admin api is disabled without a password", http.StatusForbidden)
+			return
+		}
+		username, password, ok := req.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(username), []byte(a.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(a.Password)) != 1 {
+			glog.V(1).Infof("Admin unauthenticated %s %s from %#v", req.Method, req.URL.Path, req.RemoteAddr)
+			rw.Header().Set("WWW-Authenticate", `Basic realm="goproxy admin"`)
+			http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		glog.V(1).Infof("Admin %s %s from %#v", req.Method, req.URL.String(), req.RemoteAddr)
+	}
+	a.mux.ServeHTTP(rw, req)
+}
+
+type adminFilterInfo struct {
+	Name   string
+	Type   string
+	Stages []string    `json:",omitempty"`
+	Config interface{} `json:",omitempty"`
+}
+
+func (a *Admin) serveFilters(rw http.ResponseWriter, req *http.Request) {
+	stages := make(map[filters.Filter][]string)
+	addStage := func(f filters.Filter, stage string) {
+		if u, ok := f.(interface {
+			Unwrap() filters.Filter
+		}); ok {
+			f = u.Unwrap()
+		}
+		for _, s := range stages[f] {
+			if s == stage {
+				return
+			}
+		}
+		stages[f] = append(stages[f], stage)
+	}
+	for _, h := range a.Handlers {
+		chain := h.Chain()
+		for _, f := range chain.RequestFilters {
+			addStage(f, "Request")
+		}
+		for _, f := range chain.Middlewares {
+			addStage(f, "Middleware")
+		}
+		for _, f := range chain.RoundTripFilters {
+			addStage(f, "RoundTrip")
+		}
+		for _, f := range chain.ResponseFilters {
+			addStage(f, "Response")
+		}
+		if chain.Router != nil {
+			for _, rule := range chain.Router.Rules {
+				for _, f := range rule.Middlewares {
+					addStage(f, "Middleware")
+				}
+				for _, f := range rule.ResponseFilters {
+					addStage(f, "Response")
+				}
+			}
+		}
+	}
+
+	fs := filters.Filters()
+	names := make([]string, 0, len(fs))
+	for name := range fs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	infos := make([]adminFilterInfo, 0, len(names))
+	for _, name := range names {
+		filterType, _ := filters.SplitName(name)
+		infos = append(infos, adminFilterInfo{
+			Name:   name,
+			Type:   filterType,
+			Stages: stages[fs[name]],
+			Config: redactConfig(filters.GetConfig(name)),
+		})
+	}
+
+	WriteJSON(rw, http.StatusOK, infos)
+}
+
+// redactConfig returns config as JSON values with passwords, secrets and
+// tokens masked, and the passwords of URLs removed.
+func redactConfig(config interface{}) interface{} {
+	if config == nil {
+		return nil
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil
+	}
+	return redactValue("", v)
+}
+
+func redactValue(key string, v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, v1 := range v {
+			v[k] = redactValue(k, v1)
+		}
+		return v
+	case []interface{}:
+		for i, v1 := range v {
+			v[i] = redactValue(key, v1)
+		}
+		return v
+	case string:
+		lower := strings.ToLower(key)
+		switch {
+		case v == "":
+			return v
+		case strings.Contains(lower, "password"), strings.Contains(lower, "secret"), strings.Contains(lower, "token"):
+			return "xxxxx"
+		case strings.Contains(v, "@"):
+			if u, err := url.Parse(v); err == nil && u.User != nil {
+				return u.Redacted()
+			}
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func (a *Admin) serveFilter(rw http.ResponseWriter, req *http.Request) {
+	rest := strings.TrimPrefix(req.URL.Path, "/filters/")
+	name, path := rest, "/"
+	if i := strings.Index(rest, "/"); i >= 0 {
+		name, path = rest[:i], rest[i:]
+	}
+
+	f, ok := filters.Filters()[name]
+	if !ok {
+		http.Error(rw, "filter "+name+" not loaded", http.StatusNotFound)
+		return
+	}
+
+	af, ok := f.(AdminFilter)
+	if !ok {
+		http.Error(rw, "filter "+name+" has no admin api", http.StatusNotFound)
+		return
+	}
+
+	req1 := new(http.Request)
+	*req1 = *req
+	u := *req.URL
+	u.Path = path
+	req1.URL = &u
+	af.ServeAdmin(rw, req1)
+}
+
+func (a *Admin) serveHosts(rw http.ResponseWriter, req *http.Request) {
+	host := req.URL.Query().Get("host")
+	if host == "" {
+		http.Error(rw, "missing host parameter", http.StatusBadRequest)
+		return
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	decisions := make(map[string]interface{})
+	for name, f := range filters.Filters() {
+		if hf, ok := f.(HostFilter); ok {
+			decisions[name] = hf.MatchHost(host)
+		}
+	}
+
+	routes := make(map[string]map[string]bool)
+	for _, h := range a.Handlers {
+		router := h.Chain().Router
+		if router == nil {
+			continue
+		}
+		routes[h.Name] = make(map[string]bool)
+		for _, rule := range router.Rules {
+			if rule.Hosts != nil {
+				_, ok := rule.Hosts.Lookup(host)
+				routes[h.Name][rule.Name] = ok
+			}
+		}
+	}
+	if len(routes) > 0 {
+		decisions["routes"] = routes
+	}
+
+	WriteJSON(rw, http.StatusOK, decisions)
+}
+
+// serveConns lists in-flight requests and tunnels on GET /conns, and kills
+// one on DELETE /conns/<id>.
+func (a *Admin) serveConns(rw http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.URL.Path == "/conns" && req.Method == "GET":
+		WriteJSON(rw, http.StatusOK, a.Conns.List())
+	case strings.HasPrefix(req.URL.Path, "/conns/") && req.Method == "DELETE":
+		id, err := strconv.ParseUint(strings.TrimPrefix(req.URL.Path, "/conns/"), 10, 64)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !a.Conns.Kill(id) {
+			http.Error(rw, "no such connection", http.StatusNotFound)
+			return
+		}
+		glog.Infof("Admin killed connection %d", id)
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// WriteJSON replies v encoded as JSON with status code.
+func WriteJSON(rw http.ResponseWriter, code int, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	rw.Write(append(data, '\n'))
+}
@@ -0,0 +1,131 @@
+package httpproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HijackConnect replies 200 to the CONNECT request req and returns the
+// client side of the tunnel. For HTTP/2 the tunnel is a *StreamConn over
+// req.Body and rw, the handler must not return before it is closed.
+func HijackConnect(rw http.ResponseWriter, req *http.Request) (net.Conn, error) {
+	if req.ProtoMajor == 2 {
+		flusher, ok := rw.(http.Flusher)
+		if !ok {
+			return nil, fmt.Errorf("http.ResponseWriter(%#v) does not implments http.Flusher", rw)
+		}
+
+		rw.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		return &StreamConn{
+			rw:         rw,
+			flusher:    flusher,
+			body:       req.Body,
+			remoteAddr: streamAddr(req.RemoteAddr),
+			done:       make(chan struct{}),
+		}, nil
+	}
+
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		return nil, fmt.Errorf("http.ResponseWriter(%#v) does not implments http.Hijacker", rw)
+	}
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("%#v.Hijack() error: %v", hijacker, err)
+	}
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 OK\r\n\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if brw != nil {
+		return &peekedConn{Conn: conn, r: brw.Reader}, nil
+	}
+
+	return conn, nil
+}
+
+// StreamConn is a net.Conn over a HTTP/2 CONNECT stream.
+type StreamConn struct {
+	rw         http.ResponseWriter
+	flusher    http.Flusher
+	body       io.ReadCloser
+	remoteAddr net.Addr
+	mu         sync.Mutex
+	closed     bool
+	done       chan struct{}
+}
+
+func (c *StreamConn) Read(b []byte) (int, error) {
+	return c.body.Read(b)
+}
+
+func (c *StreamConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	n, err := c.rw.Write(b)
+	if err == nil {
+		c.flusher.Flush()
+	}
+	return n, err
+}
+
+func (c *StreamConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	return c.body.Close()
+}
+
+// Done is closed when the stream is closed.
+func (c *StreamConn) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *StreamConn) LocalAddr() net.Addr {
+	return streamAddr("")
+}
+
+func (c *StreamConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *StreamConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *StreamConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *StreamConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type streamAddr string
+
+func (a streamAddr) Network() string {
+	return "h2"
+}
+
+func (a streamAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,126 @@
+package httpproxy
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"./filters"
+)
+
+// ConnInfo is a snapshot of an in-flight request or tunnel.
+type ConnInfo struct {
+	ID       uint64
+	Listener string
+	Client   string
+	User     string
+	Method   string
+	Target   string
+	Filter   string
+	Start    time.Time
+	Duration float64
+	BytesIn  int64
+	BytesOut int64
+}
+
+type connEntry struct {
+	id       uint64
+	listener string
+	client   string
+	method   string
+	target   string
+	start    time.Time
+	ctx      *filters.Context
+	rw       *countingResponseWriter
+	mu       sync.Mutex
+	filter   string
+}
+
+func (e *connEntry) setFilter(name string) {
+	e.mu.Lock()
+	e.filter = name
+	e.mu.Unlock()
+}
+
+func (e *connEntry) info(now time.Time) ConnInfo {
+	e.mu.Lock()
+	filter := e.filter
+	e.mu.Unlock()
+
+	return ConnInfo{
+		ID:       e.id,
+		Listener: e.listener,
+		Client:   e.client,
+		User:     e.ctx.GetUsername(),
+		Method:   e.method,
+		Target:   e.target,
+		Filter:   filter,
+		Start:    e.start,
+		Duration: now.Sub(e.start).Seconds(),
+		BytesIn:  atomic.LoadInt64(&e.rw.bytesIn),
+		BytesOut: atomic.LoadInt64(&e.rw.bytesOut),
+	}
+}
+
+// ConnTable keeps the in-flight requests and tunnels of Handlers, which may
+// share one table.
+type ConnTable struct {
+	mu      sync.Mutex
+	lastID  uint64
+	entries map[uint64]*connEntry
+}
+
+func NewConnTable() *ConnTable {
+	return &ConnTable{
+		entries: make(map[uint64]*connEntry),
+	}
+}
+
+func (t *ConnTable) add(e *connEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastID++
+	e.id = t.lastID
+	t.entries[e.id] = e
+}
+
+func (t *ConnTable) remove(e *connEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, e.id)
+}
+
+// List returns the in-flight requests and tunnels, oldest first.
+func (t *ConnTable) List() []ConnInfo {
+	t.mu.Lock()
+	entries := make([]*connEntry, 0, len(t.entries))
+	for _, e := range t.entries {
+		entries = append(entries, e)
+	}
+	t.mu.Unlock()
+
+	now := time.Now()
+	infos := make([]ConnInfo, len(entries))
+	for i, e := range entries {
+		infos[i] = e.info(now)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// Kill cancels the request id and closes its connections, it reports false
+// if there is no such request.
+func (t *ConnTable) Kill(id uint64) bool {
+	t.mu.Lock()
+	e, ok := t.entries[id]
+	t.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	e.ctx.Kill()
+	return true
+}
@@ -0,0 +1,76 @@
+package httpproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	defaultFailoverMaxBodySize int64 = 1024 * 1024
+)
+
+// CONNECT is replayable since tunnel filters dial before they write anything.
+var idempotentMethods = map[string]struct{}{
+	"GET":     {},
+	"HEAD":    {},
+	"OPTIONS": {},
+	"TRACE":   {},
+	"PUT":     {},
+	"DELETE":  {},
+	"CONNECT": {},
+}
+
+// Failover retries a request on the next RoundTripFilter when a filter
+// returns an error or one of StatusCodes.
+type Failover struct {
+	StatusCodes map[int]struct{}
+	MaxBodySize int64
+}
+
+func NewFailover(statusCodes []int, maxBodySize int64) *Failover {
+	f := &Failover{
+		StatusCodes: make(map[int]struct{}),
+		MaxBodySize: maxBodySize,
+	}
+	if f.MaxBodySize <= 0 {
+		f.MaxBodySize = defaultFailoverMaxBodySize
+	}
+	for _, code := range statusCodes {
+		f.StatusCodes[code] = struct{}{}
+	}
+	return f
+}
+
+// Prepare reports whether req can be replayed, the body of req is buffered
+// into memory up to MaxBodySize. It returns a rewind func for replaying.
+func (f *Failover) Prepare(req *http.Request) (func(), bool) {
+	if _, ok := idempotentMethods[req.Method]; !ok {
+		return nil, false
+	}
+
+	if req.Method == "CONNECT" || req.Body == nil || req.Body == http.NoBody {
+		return func() {}, true
+	}
+
+	if req.ContentLength > f.MaxBodySize {
+		return nil, false
+	}
+
+	body := req.Body
+	data, err := ioutil.ReadAll(io.LimitReader(body, f.MaxBodySize+1))
+	if err != nil || int64(len(data)) > f.MaxBodySize {
+		req.Body = NewMultiReadCloser(bytes.NewReader(data), body)
+		return nil, false
+	}
+
+	return func() {
+		req.Body = ioutil.NopCloser(bytes.NewReader(data))
+	}, true
+}
+
+func (f *Failover) Match(resp *http.Response) bool {
+	_, ok := f.StatusCodes[resp.StatusCode]
+	return ok
+}
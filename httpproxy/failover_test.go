@@ -0,0 +1,101 @@
+package httpproxy
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type errReader struct{}
+
+func (errReader) Read(b []byte) (int, error) {
+	return 0, errors.New("read error")
+}
+
+func TestFailoverPrepare(t *testing.T) {
+	f := NewFailover([]int{502}, 8)
+
+	tests := []struct {
+		name          string
+		method        string
+		body          io.Reader
+		contentLength int64
+		ok            bool
+		data          string
+	}{
+		{"get", "GET", nil, 0, true, ""},
+		{"no body", "PUT", http.NoBody, 0, true, ""},
+		{"connect", "CONNECT", nil, 0, true, ""},
+		{"put", "PUT", strings.NewReader("12345678"), 8, true, "12345678"},
+		{"chunked put", "PUT", strings.NewReader("1234"), -1, true, "1234"},
+		{"post", "POST", strings.NewReader("1234"), 4, false, "1234"},
+		{"patch", "PATCH", nil, 0, false, ""},
+		{"declared too large", "PUT", strings.NewReader("123456789"), 9, false, "123456789"},
+		{"chunked too large", "PUT", strings.NewReader("123456789abc"), -1, false, "123456789abc"},
+		{"read error", "PUT", io.MultiReader(strings.NewReader("1234"), errReader{}), -1, false, "1234"},
+	}
+
+	for _, tt := range tests {
+		req := &http.Request{Method: tt.method, ContentLength: tt.contentLength, Header: http.Header{}}
+		if tt.body != nil {
+			req.Body = ioutil.NopCloser(tt.body)
+		}
+
+		rewind, ok := f.Prepare(req)
+		if ok != tt.ok {
+			t.Errorf("%s: Prepare() = %v, want %v", tt.name, ok, tt.ok)
+			continue
+		}
+		if !ok {
+			// the body must be left intact for the single attempt
+			if req.Body == nil {
+				continue
+			}
+			if data, _ := ioutil.ReadAll(req.Body); string(data) != tt.data {
+				t.Errorf("%s: body = %q, want %q", tt.name, data, tt.data)
+			}
+			continue
+		}
+
+		for i := 0; i < 2; i++ {
+			rewind()
+			if req.Body == nil || req.Body == http.NoBody {
+				if tt.data != "" {
+					t.Errorf("%s: attempt %d has no body, want %q", tt.name, i, tt.data)
+				}
+				continue
+			}
+			if data, _ := ioutil.ReadAll(req.Body); string(data) != tt.data {
+				t.Errorf("%s: attempt %d body = %q, want %q", tt.name, i, data, tt.data)
+			}
+		}
+	}
+}
+
+func TestFailoverMatch(t *testing.T) {
+	f := NewFailover([]int{502, 503}, 0)
+	if f.MaxBodySize != defaultFailoverMaxBodySize {
+		t.Errorf("MaxBodySize = %d, want %d", f.MaxBodySize, defaultFailoverMaxBodySize)
+	}
+
+	tests := []struct {
+		status int
+		match  bool
+	}{
+		{200, false},
+		{404, false},
+		{500, false},
+		{502, true},
+		{503, true},
+		{504, false},
+	}
+
+	for _, tt := range tests {
+		if got := f.Match(&http.Response{StatusCode: tt.status}); got != tt.match {
+			t.Errorf("Match(%d) = %v, want %v", tt.status, got, tt.match)
+		}
+	}
+}
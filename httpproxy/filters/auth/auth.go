@@ -10,8 +10,9 @@ import (
 	"github.com/cloudflare/golibs/lrucache"
 	"github.com/golang/glog"
 
-	"../../../storage"
+	"../../../httpproxy"
 	"../../filters"
+	"../../metrics"
 )
 
 const (
@@ -20,6 +21,8 @@ const (
 	bypassHeader string = filterName + "/bypass"
 )
 
+var authRequired = metrics.NewCounter("goproxy_auth_required_total", "Requests answered with 407 Proxy Authentication Required.")
+
 type Config struct {
 	CacheSize int
 	Basic     []struct {
@@ -30,22 +33,20 @@ type Config struct {
 }
 
 type Filter struct {
+	name          string
 	ByPassHeaders lrucache.Cache
 	Basic         map[string]string
 	WhiteList     map[string]struct{}
 }
 
 func init() {
-	filename := filterName + ".json"
-	config := new(Config)
-	err := storage.ReadJsonConfig(filters.LookupConfigStoreURI(filterName), filename, config)
-	if err != nil {
-		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
-	}
-
-	err = filters.Register(filterName, &filters.RegisteredFilter{
-		New: func() (filters.Filter, error) {
-			return NewFilter(config)
+	err := filters.Register(filterName, &filters.RegisteredFilter{
+		New: func(name string) (filters.Filter, error) {
+			config := new(Config)
+			if err := filters.ReadConfig(name, config); err != nil {
+				return nil, err
+			}
+			return NewFilter(name, config)
 		},
 	})
 
@@ -54,8 +55,9 @@ func init() {
 	}
 }
 
-func NewFilter(config *Config) (filters.Filter, error) {
+func NewFilter(name string, config *Config) (filters.Filter, error) {
 	f := &Filter{
+		name:          name,
 		ByPassHeaders: lrucache.NewMultiLRUCache(4, uint(config.CacheSize)),
 		Basic:         make(map[string]string),
 		WhiteList:     make(map[string]struct{}),
@@ -73,7 +75,16 @@ func NewFilter(config *Config) (filters.Filter, error) {
 }
 
 func (f *Filter) FilterName() string {
-	return filterName
+	return f.name
+}
+
+func (f *Filter) ServeAdmin(rw http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.URL.Path == "/flush" && req.Method == "POST":
+		httpproxy.WriteJSON(rw, http.StatusOK, map[string]int{"Flushed": f.ByPassHeaders.Clear()})
+	default:
+		http.NotFound(rw, req)
+	}
 }
 
 func (f *Filter) Request(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Request, error) {
@@ -84,17 +95,34 @@ func (f *Filter) Request(ctx *filters.Context, req *http.Request) (*filters.Cont
 	return ctx, req, nil
 }
 
-func (f *Filter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Response, error) {
-
-	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+func (f *Filter) whiteListed(remoteAddr string) bool {
+	if ip, _, err := net.SplitHostPort(remoteAddr); err == nil {
 		if _, ok := f.WhiteList[ip]; ok {
-			return ctx, nil, nil
+			return true
 		}
 	}
+	return false
+}
+
+// CheckCredential checks the username and password of SOCKS5 clients.
+func (f *Filter) CheckCredential(remoteAddr, username, password string) bool {
+	if f.whiteListed(remoteAddr) {
+		return true
+	}
+	pass, ok := f.Basic[username]
+	return ok && pass == password
+}
+
+func (f *Filter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Response, error) {
+
+	if f.whiteListed(req.RemoteAddr) {
+		return ctx, nil, nil
+	}
 
 	if auth, err := ctx.GetString(authHeader); err == nil {
-		if _, ok := f.ByPassHeaders.Get(auth); ok {
+		if user, ok := f.ByPassHeaders.Get(auth); ok {
 			glog.V(3).Infof("auth filter hit bypass cache %#v", auth)
+			ctx.SetUsername(user.(string))
 			return ctx, nil, nil
 		}
 		parts := strings.SplitN(auth, " ", 2)
@@ -102,12 +130,16 @@ func (f *Filter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Co
 			switch parts[0] {
 			case "Basic":
 				if userpass, err := base64.StdEncoding.DecodeString(parts[1]); err == nil {
-					parts := strings.Split(string(userpass), ":")
+					parts := strings.SplitN(string(userpass), ":", 2)
+					if len(parts) != 2 {
+						break
+					}
 					user := parts[0]
 					pass := parts[1]
 					pass1, ok := f.Basic[user]
 					if ok && pass == pass1 {
-						f.ByPassHeaders.Set(auth, struct{}{}, time.Now().Add(time.Hour))
+						f.ByPassHeaders.Set(auth, user, time.Now().Add(time.Hour))
+						ctx.SetUsername(user)
 						return ctx, nil, nil
 					}
 				}
@@ -119,6 +151,7 @@ func (f *Filter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Co
 	}
 
 	glog.V(1).Infof("UnAuthenticated URL %v from %#v", req.URL.String(), req.RemoteAddr)
+	authRequired.Inc()
 
 	noAuthResponse := &http.Response{
 		Status:        "407 Proxy authentication required",
@@ -3,7 +3,9 @@ package autoproxy
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -25,8 +27,9 @@ const (
 )
 
 type Config struct {
-	Sites   []string
-	GFWList struct {
+	Sites     []string
+	Transport string
+	GFWList   struct {
 		URL      string
 		File     string
 		Encoding string
@@ -34,10 +37,6 @@ type Config struct {
 	}
 }
 
-var (
-	onceUpdater sync.Once
-)
-
 type GFWList struct {
 	URL      *url.URL
 	Filename string
@@ -46,25 +45,33 @@ type GFWList struct {
 }
 
 type Filter struct {
+	name          string
 	Store         storage.Store
 	Sites         *httpproxy.HostMatcher
 	GFWList       *GFWList
 	AutoProxy2Pac *AutoProxy2Pac
-	Transport     *http.Transport
+	Transport     http.RoundTripper
 	UpdateChan    chan struct{}
+	ctx           context.Context
+	cancel        context.CancelFunc
+	done          chan struct{}
 }
 
-func init() {
-	filename := filterName + ".json"
-	config := new(Config)
-	err := storage.ReadJsonConfig(filters.LookupConfigStoreURI(filterName), filename, config)
-	if err != nil {
-		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
-	}
+var (
+	// updaters are the started filters by gfwlist file, only the first one
+	// runs the updater, the next one takes over when it is closed
+	updaters   = make(map[string][]*Filter)
+	muUpdaters sync.Mutex
+)
 
-	err = filters.Register(filterName, &filters.RegisteredFilter{
-		New: func() (filters.Filter, error) {
-			return NewFilter(config)
+func init() {
+	err := filters.Register(filterName, &filters.RegisteredFilter{
+		New: func(name string) (filters.Filter, error) {
+			config := new(Config)
+			if err := filters.ReadConfig(name, config); err != nil {
+				return nil, err
+			}
+			return NewFilter(name, config)
 		},
 	})
 
@@ -73,7 +80,7 @@ func init() {
 	}
 }
 
-func NewFilter(config *Config) (_ filters.Filter, err error) {
+func NewFilter(name string, config *Config) (_ filters.Filter, err error) {
 	var gfwlist GFWList
 
 	gfwlist.Encoding = config.GFWList.Encoding
@@ -120,11 +127,26 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 		return nil, err
 	}
 
-	transport := &http.Transport{
+	var transport http.RoundTripper = &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
 	}
 
+	if config.Transport != "" {
+		f1, err := filters.GetTransport(name, config.Transport)
+		if err != nil {
+			return nil, err
+		}
+
+		f2, ok := f1.(filters.RoundTripFilter)
+		if !ok {
+			return nil, fmt.Errorf("%#v was not a filters.RoundTripFilter", f1)
+		}
+
+		transport = &filters.RoundTripper{Filter: f2}
+	}
+
 	f := &Filter{
+		name:          name,
 		Store:         store,
 		Sites:         httpproxy.NewHostMatcher(config.Sites),
 		GFWList:       &gfwlist,
@@ -133,28 +155,114 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 		UpdateChan:    make(chan struct{}),
 	}
 
-	go onceUpdater.Do(f.updater)
-
 	return f, nil
 }
 
 func (f *Filter) FilterName() string {
-	return filterName
+	return f.name
+}
+
+func (f *Filter) ServeAdmin(rw http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.URL.Path == "/update" && req.Method == "POST":
+		select {
+		case f.updaterFilter().UpdateChan <- struct{}{}:
+			httpproxy.WriteJSON(rw, http.StatusAccepted, map[string]string{"GFWList": f.GFWList.URL.String()})
+		default:
+			http.Error(rw, "gfwlist update in progress", http.StatusConflict)
+		}
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+// updaterFilter returns the filter running the updater of f.GFWList.Filename
+func (f *Filter) updaterFilter() *Filter {
+	muUpdaters.Lock()
+	defer muUpdaters.Unlock()
+	if fs := updaters[f.GFWList.Filename]; len(fs) > 0 {
+		return fs[0]
+	}
+	return f
+}
+
+// Start runs the gfwlist updater until ctx is done or f is closed, unless
+// another filter updates the same file.
+func (f *Filter) Start(ctx context.Context) error {
+	muUpdaters.Lock()
+	defer muUpdaters.Unlock()
+	f.ctx = ctx
+	fs := append(updaters[f.GFWList.Filename], f)
+	updaters[f.GFWList.Filename] = fs
+	if len(fs) == 1 {
+		f.startUpdater()
+	}
+	return nil
+}
+
+// startUpdater must be called with muUpdaters held
+func (f *Filter) startUpdater() {
+	var ctx context.Context
+	ctx, f.cancel = context.WithCancel(f.ctx)
+	f.done = make(chan struct{})
+	go f.updater(ctx)
+}
+
+func (f *Filter) Close(ctx context.Context) error {
+	if t, ok := f.Transport.(*http.Transport); ok {
+		t.CloseIdleConnections()
+	}
+
+	muUpdaters.Lock()
+	fs := updaters[f.GFWList.Filename]
+	for i, f1 := range fs {
+		if f1 == f {
+			fs = append(fs[:i:i], fs[i+1:]...)
+			break
+		}
+	}
+	if len(fs) == 0 {
+		delete(updaters, f.GFWList.Filename)
+	} else {
+		updaters[f.GFWList.Filename] = fs
+		if fs[0].cancel == nil {
+			fs[0].startUpdater()
+		}
+	}
+	cancel, done := f.cancel, f.done
+	muUpdaters.Unlock()
+
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (f *Filter) updater() {
+func (f *Filter) updater(ctx context.Context) {
 	glog.V(2).Infof("start updater for %#v", f.GFWList)
+	defer close(f.done)
 
-	ticker := time.Tick(10 * time.Minute)
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
 
 	for {
 		needUpdate := false
 
 		select {
+		case <-ctx.Done():
+			glog.V(2).Infof("stop updater for %#v", f.GFWList)
+			return
 		case <-f.UpdateChan:
 			glog.Infof("Begin manual gfwlist(%#v) update...", f.GFWList.URL.String())
 			needUpdate = true
-		case <-ticker:
+		case <-ticker.C:
 			break
 		}
 
@@ -186,6 +294,7 @@ func (f *Filter) updater() {
 				glog.Warningf("NewRequest(%#v) error: %v", f.GFWList.URL.String(), err)
 				continue
 			}
+			req = req.WithContext(ctx)
 
 			glog.Infof("Downloading %#v", f.GFWList.URL.String())
 
@@ -204,9 +313,9 @@ func (f *Filter) updater() {
 			}
 
 			data, err := ioutil.ReadAll(r)
+			resp.Body.Close()
 			if err != nil {
 				glog.Warningf("ReadAll(%#v) error: %v", r, err)
-				resp.Body.Close()
 				continue
 			}
 
@@ -223,7 +332,6 @@ func (f *Filter) updater() {
 			}
 
 			glog.Infof("Update %#v from %#v OK", f.GFWList.Filename, f.GFWList.URL.String())
-			resp.Body.Close()
 		}
 	}
 }
@@ -234,10 +342,6 @@ func (f *Filter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Co
 		return ctx, nil, nil
 	}
 
-	if strings.Contains(req.URL.Query().Encode(), "flush") {
-		f.UpdateChan <- struct{}{}
-	}
-
 	data := f.AutoProxy2Pac.GeneratePac(req)
 
 	resp := &http.Response{
@@ -253,7 +357,5 @@ func (f *Filter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Co
 		Body:          ioutil.NopCloser(bytes.NewReader([]byte(data))),
 	}
 
-	glog.Infof("%s \"AUTOPROXY %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.RequestURI, req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
-
 	return ctx, resp, nil
 }
@@ -0,0 +1,522 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"../../../httpproxy"
+	"../../../storage"
+	"../../filters"
+)
+
+const (
+	filterName string = "cache"
+
+	cacheTimeHeader  = "X-Cache-Time"
+	cacheVaryHeader  = "X-Cache-Vary"
+	ctxKeyLookup     = "cache.lookup"
+	ctxKeyUncached   = "cache.uncached"
+	ctxKeyHit        = "cache.hit"
+	ctxKeyRevalidate = "cache.revalidate"
+
+	defaultMaxObjectSize int64 = 32 * 1024 * 1024
+)
+
+type Config struct {
+	Store         string
+	MaxSize       int64
+	MaxObjectSize int64
+	Sites         []string
+}
+
+type Filter struct {
+	name          string
+	Store         storage.Store
+	Index         *Index
+	MaxObjectSize int64
+	Sites         *httpproxy.HostMatcher
+	muVary        sync.Mutex
+	// vary caches the Vary names of stored urls by the object name of the url
+	vary map[string][]string
+}
+
+func init() {
+	err := filters.Register(filterName, &filters.RegisteredFilter{
+		New: func(name string) (filters.Filter, error) {
+			config := new(Config)
+			if err := filters.ReadConfig(name, config); err != nil {
+				return nil, err
+			}
+			return NewFilter(name, config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(name string, config *Config) (filters.Filter, error) {
+	var dirname string
+	if strings.HasPrefix(config.Store, "file://") {
+		dirname = strings.TrimPrefix(config.Store, "file://")
+		if err := os.MkdirAll(dirname, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	store, err := storage.OpenURI(config.Store)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Filter{
+		name:          name,
+		Store:         store,
+		MaxObjectSize: config.MaxObjectSize,
+		Sites:         httpproxy.NewHostMatcher(config.Sites),
+		vary:          make(map[string][]string),
+	}
+
+	if f.MaxObjectSize <= 0 {
+		f.MaxObjectSize = defaultMaxObjectSize
+	}
+
+	f.Index = NewIndex(config.MaxSize, func(name string) {
+		f.forgetVary(name)
+		if err := f.Store.DeleteObject(name); err != nil {
+			glog.Warningf("%T.DeleteObject(%#v) error: %v", f.Store, name, err)
+		}
+	})
+
+	if dirname != "" {
+		f.loadIndex(dirname)
+	}
+
+	return f, nil
+}
+
+func (f *Filter) FilterName() string {
+	return f.name
+}
+
+func (f *Filter) MatchHost(host string) map[string]interface{} {
+	return map[string]interface{}{"Sites": f.Sites.Match(host)}
+}
+
+// loadIndex indexes objects stored by previous runs, oldest first.
+func (f *Filter) loadIndex(dirname string) {
+	fis, err := ioutil.ReadDir(dirname)
+	if err != nil {
+		glog.Warningf("ReadDir(%#v) error: %v", dirname, err)
+		return
+	}
+
+	sort.Slice(fis, func(i, j int) bool {
+		return fis[i].ModTime().Before(fis[j].ModTime())
+	})
+
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && len(fi.Name()) == sha1.Size*2 {
+			f.Index.Add(fi.Name(), fi.Size())
+		}
+	}
+
+	size, count := f.Index.Size()
+	glog.V(2).Infof("cache %#v loaded %d objects, %d bytes", dirname, count, size)
+}
+
+// objectName returns the object name of req, the url hashed with the request
+// headers named by the Vary of the stored response.
+func (f *Filter) objectName(req *http.Request) string {
+	key := req.URL.String()
+	base := fmt.Sprintf("%x", sha1.Sum([]byte(key)))
+
+	names := f.varyNames(base)
+	if len(names) == 0 {
+		return base
+	}
+
+	for _, name := range names {
+		key += "\n" + name + ": " + strings.Join(req.Header[name], ",")
+	}
+
+	return fmt.Sprintf("%x", sha1.Sum([]byte(key)))
+}
+
+// varyNames returns the Vary names of the url whose object name is base. A url
+// with Vary keeps its names in a record stored as base, so that they survive
+// restarts.
+func (f *Filter) varyNames(base string) []string {
+	f.muVary.Lock()
+	names, ok := f.vary[base]
+	f.muVary.Unlock()
+	if ok || !f.Index.Has(base) {
+		return names
+	}
+
+	resp, _, err := f.load(base)
+	if err != nil {
+		return nil
+	}
+	resp.Body.Close()
+	names = parseVary(resp.Header[cacheVaryHeader])
+
+	f.muVary.Lock()
+	f.vary[base] = names
+	f.muVary.Unlock()
+	return names
+}
+
+// setVary records the Vary names of resp before it is stored.
+func (f *Filter) setVary(req *http.Request, resp *http.Response) error {
+	names := parseVary(resp.Header["Vary"])
+	base := fmt.Sprintf("%x", sha1.Sum([]byte(req.URL.String())))
+
+	f.muVary.Lock()
+	f.vary[base] = names
+	f.muVary.Unlock()
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	record := &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Header:     http.Header{cacheVaryHeader: {strings.Join(names, ", ")}},
+	}
+	return f.save(base, record, nil)
+}
+
+func (f *Filter) forgetVary(name string) {
+	f.muVary.Lock()
+	delete(f.vary, name)
+	f.muVary.Unlock()
+}
+
+func parseVary(values []string) []string {
+	names := make([]string, 0)
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Request looks up the cache, the response found is served by RoundTrip so
+// that filters checking clients, e.g. auth, run before it.
+func (f *Filter) Request(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Request, error) {
+	if req.Method != "GET" || !f.Sites.Match(req.Host) {
+		return ctx, req, nil
+	}
+
+	reqcc := parseCacheControl(req.Header)
+	if reqcc.Has("no-store") {
+		return ctx, req, nil
+	}
+
+	name := f.objectName(req)
+	if !f.Index.Touch(name) {
+		if reqcc.Has("only-if-cached") {
+			ctx.SetBool(ctxKeyUncached, true)
+		}
+		return ctx, req, nil
+	}
+
+	ctx.SetString(ctxKeyLookup, name)
+	return ctx, req, nil
+}
+
+// RoundTrip replies fresh responses found by Request, stale ones are
+// revalidated by the next RoundTrip filters.
+func (f *Filter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Response, error) {
+	if uncached, _ := ctx.GetBool(ctxKeyUncached); uncached {
+		ctx.SetBool(ctxKeyHit, true)
+		return ctx, &http.Response{
+			Status:        "504 Gateway Timeout",
+			StatusCode:    http.StatusGatewayTimeout,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{},
+			Request:       req,
+			ContentLength: 0,
+		}, nil
+	}
+
+	name, err := ctx.GetString(ctxKeyLookup)
+	if err != nil {
+		return ctx, nil, nil
+	}
+
+	resp, storeTime, err := f.load(name)
+	if err != nil {
+		glog.Warningf("%s \"CACHE %s %s %s\" load %#v error: %v", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, name, err)
+		f.Index.Remove(name)
+		f.forgetVary(name)
+		return ctx, nil, nil
+	}
+
+	if resp.Header.Get(cacheVaryHeader) != "" {
+		resp.Body.Close()
+		return ctx, nil, nil
+	}
+
+	if fresh(req, resp, storeTime) || parseCacheControl(req.Header).Has("only-if-cached") {
+		resp.Header.Set("Age", strconv.FormatInt(int64(currentAge(resp, storeTime)/time.Second), 10))
+		resp.Header.Set("X-Cache", "HIT")
+		resp.Request = req
+		ctx.SetBool(ctxKeyHit, true)
+		if notModified(req, resp) {
+			resp.Body.Close()
+			return ctx, notModifiedResponse(req, resp), nil
+		}
+		return ctx, resp, nil
+	}
+	resp.Body.Close()
+
+	// revalidate with our validators, conditional requests of clients are passed through
+	if req.Header.Get("If-None-Match") == "" && req.Header.Get("If-Modified-Since") == "" {
+		etag, lm := resp.Header.Get("Etag"), resp.Header.Get("Last-Modified")
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lm != "" {
+			req.Header.Set("If-Modified-Since", lm)
+		}
+		if etag != "" || lm != "" {
+			ctx.SetString(ctxKeyRevalidate, name)
+		}
+	}
+
+	return ctx, nil, nil
+}
+
+func (f *Filter) Response(ctx *filters.Context, resp *http.Response) (*filters.Context, *http.Response, error) {
+	req := resp.Request
+	if req == nil || req.Method != "GET" || !f.Sites.Match(req.Host) {
+		return ctx, resp, nil
+	}
+
+	if hit, _ := ctx.GetBool(ctxKeyHit); hit {
+		return ctx, resp, nil
+	}
+
+	if name, err := ctx.GetString(ctxKeyRevalidate); err == nil && resp.StatusCode == http.StatusNotModified {
+		resp1, err := f.revalidate(name, resp)
+		if err != nil {
+			glog.Warningf("%s \"CACHE %s %s %s\" revalidate %#v error: %v", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, name, err)
+			return ctx, resp, nil
+		}
+		resp.Body.Close()
+		resp1.Request = req
+		return ctx, resp1, nil
+	}
+
+	if !storable(req, resp) || resp.ContentLength > f.MaxObjectSize {
+		return ctx, resp, nil
+	}
+
+	if err := f.setVary(req, resp); err != nil {
+		glog.Warningf("%s \"CACHE %s %s %s\" save Vary error: %v", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, err)
+		return ctx, resp, nil
+	}
+	name := f.objectName(req)
+
+	resp1 := &http.Response{
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+		Header:     cloneHeader(resp.Header),
+	}
+
+	resp.Body = &teeBody{
+		rc:     resp.Body,
+		length: resp.ContentLength,
+		limit:  f.MaxObjectSize,
+		done: func(data []byte) {
+			if err := f.save(name, resp1, data); err != nil {
+				glog.Warningf("%s \"CACHE %s %s %s\" save %#v error: %v", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, name, err)
+			}
+		},
+	}
+
+	return ctx, resp, nil
+}
+
+// revalidate refreshes the stored response name with the 304 response resp.
+func (f *Filter) revalidate(name string, resp *http.Response) (*http.Response, error) {
+	cached, _, err := f.load(name)
+	if err != nil {
+		return nil, err
+	}
+	defer cached.Body.Close()
+
+	data, err := ioutil.ReadAll(cached.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range []string{"Cache-Control", "Date", "Etag", "Expires", "Last-Modified", "Vary"} {
+		if values, ok := resp.Header[key]; ok {
+			cached.Header[key] = values
+		}
+	}
+	cached.Header.Del("Age")
+
+	if err := f.save(name, cached, data); err != nil {
+		return nil, err
+	}
+
+	cached.Header.Set("X-Cache", "REVALIDATED")
+	cached.ContentLength = int64(len(data))
+	cached.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	cached.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return cached, nil
+}
+
+// notModifiedResponse returns a 304 response with the headers of resp that
+// a 304 carries, RFC 7232 section 4.1.
+func notModifiedResponse(req *http.Request, resp *http.Response) *http.Response {
+	header := http.Header{}
+	for _, key := range []string{"Age", "Cache-Control", "Content-Location", "Date", "Etag", "Expires", "Last-Modified", "Vary", "X-Cache"} {
+		if values, ok := resp.Header[key]; ok {
+			header[key] = values
+		}
+	}
+
+	return &http.Response{
+		Status:        "304 Not Modified",
+		StatusCode:    http.StatusNotModified,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Request:       req,
+		ContentLength: 0,
+	}
+}
+
+func (f *Filter) load(name string) (*http.Response, time.Time, error) {
+	o, err := f.Store.GetObject(name, -1, -1)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	rc := o.Body()
+	resp, err := http.ReadResponse(bufio.NewReader(rc), nil)
+	if err != nil {
+		rc.Close()
+		return nil, time.Time{}, err
+	}
+	resp.Body = &readCloser{resp.Body, rc}
+
+	n, err := strconv.ParseInt(resp.Header.Get(cacheTimeHeader), 10, 64)
+	if err != nil {
+		resp.Body.Close()
+		return nil, time.Time{}, fmt.Errorf("invalid %s header: %#v", cacheTimeHeader, resp.Header.Get(cacheTimeHeader))
+	}
+	resp.Header.Del(cacheTimeHeader)
+
+	return resp, time.Unix(n, 0), nil
+}
+
+func (f *Filter) save(name string, resp *http.Response, data []byte) error {
+	header := cloneHeader(resp.Header)
+	for _, key := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Trailer", "Upgrade", "Content-Length", "X-Cache"} {
+		header.Del(key)
+	}
+	header.Set(cacheTimeHeader, strconv.FormatInt(time.Now().Unix(), 10))
+
+	resp1 := &http.Response{
+		Status:        resp.Status,
+		StatusCode:    resp.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: int64(len(data)),
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+	}
+
+	var b bytes.Buffer
+	if err := resp1.Write(&b); err != nil {
+		return err
+	}
+
+	size := int64(b.Len())
+	if err := f.Store.PutObject(name, http.Header{}, ioutil.NopCloser(&b)); err != nil {
+		return err
+	}
+
+	f.Index.Add(name, size)
+	return nil
+}
+
+func cloneHeader(h http.Header) http.Header {
+	h1 := make(http.Header, len(h))
+	for key, values := range h {
+		h1[key] = append([]string(nil), values...)
+	}
+	return h1
+}
+
+// teeBody keeps a copy of the body read by clients, done is called with the
+// data once the whole body was read within limit.
+type teeBody struct {
+	rc       io.ReadCloser
+	buf      bytes.Buffer
+	length   int64
+	limit    int64
+	overflow bool
+	finished bool
+	done     func(data []byte)
+}
+
+func (b *teeBody) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	if !b.overflow && !b.finished {
+		b.buf.Write(p[:n])
+		if int64(b.buf.Len()) > b.limit {
+			b.overflow = true
+			b.buf.Reset()
+		}
+		if err == io.EOF {
+			b.finished = true
+			if b.length < 0 || int64(b.buf.Len()) == b.length {
+				go b.done(b.buf.Bytes())
+			}
+		}
+	}
+	return n, err
+}
+
+func (b *teeBody) Close() error {
+	return b.rc.Close()
+}
+
+type readCloser struct {
+	io.Reader
+	rc io.ReadCloser
+}
+
+func (r *readCloser) Close() error {
+	return r.rc.Close()
+}
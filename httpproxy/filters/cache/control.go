@@ -0,0 +1,213 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheControl is the parsed directives of Cache-Control header(s).
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := make(cacheControl)
+	for _, value := range h["Cache-Control"] {
+		for _, part := range strings.Split(value, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			if i := strings.Index(part, "="); i > 0 {
+				cc[strings.ToLower(strings.TrimSpace(part[:i]))] = strings.Trim(strings.TrimSpace(part[i+1:]), "\"")
+			} else {
+				cc[strings.ToLower(part)] = ""
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) Has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// Seconds returns the delta-seconds value of directive name.
+func (cc cacheControl) Seconds(name string) (time.Duration, bool) {
+	value, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+var cacheableStatus = map[int]struct{}{
+	200: {},
+	203: {},
+	300: {},
+	301: {},
+	404: {},
+	410: {},
+}
+
+// storable reports whether a shared cache may store resp, RFC 7234 section 3.
+func storable(req *http.Request, resp *http.Response) bool {
+	if req.Method != "GET" {
+		return false
+	}
+
+	if _, ok := cacheableStatus[resp.StatusCode]; !ok {
+		return false
+	}
+
+	reqcc := parseCacheControl(req.Header)
+	respcc := parseCacheControl(resp.Header)
+
+	if reqcc.Has("no-store") || respcc.Has("no-store") || respcc.Has("private") {
+		return false
+	}
+
+	if req.Header.Get("Authorization") != "" && !respcc.Has("public") && !respcc.Has("s-maxage") && !respcc.Has("must-revalidate") {
+		return false
+	}
+
+	if resp.Header.Get("Set-Cookie") != "" || resp.Header.Get("Vary") == "*" {
+		return false
+	}
+
+	return respcc.Has("max-age") ||
+		respcc.Has("s-maxage") ||
+		respcc.Has("public") ||
+		resp.Header.Get("Expires") != "" ||
+		resp.Header.Get("Last-Modified") != "" ||
+		resp.Header.Get("Etag") != ""
+}
+
+// freshnessLifetime computes the freshness lifetime of resp, RFC 7234 section 4.2.1.
+func freshnessLifetime(resp *http.Response) time.Duration {
+	respcc := parseCacheControl(resp.Header)
+
+	if respcc.Has("no-cache") {
+		return 0
+	}
+
+	if d, ok := respcc.Seconds("s-maxage"); ok {
+		return d
+	}
+
+	if d, ok := respcc.Seconds("max-age"); ok {
+		return d
+	}
+
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		date = time.Now()
+	}
+
+	if v := resp.Header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil || expires.Before(date) {
+			return 0
+		}
+		return expires.Sub(date)
+	}
+
+	// heuristic freshness, 10% of the time since last modified
+	if lm, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil && lm.Before(date) {
+		d := date.Sub(lm) / 10
+		if d > 24*time.Hour {
+			d = 24 * time.Hour
+		}
+		return d
+	}
+
+	return 0
+}
+
+// currentAge computes the age of resp stored at storeTime, RFC 7234 section 4.2.3.
+func currentAge(resp *http.Response, storeTime time.Time) time.Duration {
+	var age time.Duration
+	if n, err := strconv.ParseInt(resp.Header.Get("Age"), 10, 64); err == nil && n > 0 {
+		age = time.Duration(n) * time.Second
+	}
+
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil && storeTime.After(date) {
+		if d := storeTime.Sub(date); d > age {
+			age = d
+		}
+	}
+
+	return age + time.Since(storeTime)
+}
+
+// fresh reports whether the stored resp satisfies req without revalidation.
+func fresh(req *http.Request, resp *http.Response, storeTime time.Time) bool {
+	reqcc := parseCacheControl(req.Header)
+	if reqcc.Has("no-cache") || req.Header.Get("Pragma") == "no-cache" {
+		return false
+	}
+
+	respcc := parseCacheControl(resp.Header)
+	lifetime := freshnessLifetime(resp)
+	age := currentAge(resp, storeTime)
+
+	if d, ok := reqcc.Seconds("max-age"); ok && age > d {
+		return false
+	}
+
+	if d, ok := reqcc.Seconds("min-fresh"); ok {
+		age += d
+	}
+
+	if age < lifetime {
+		return true
+	}
+
+	if respcc.Has("must-revalidate") || respcc.Has("proxy-revalidate") || respcc.Has("s-maxage") {
+		return false
+	}
+
+	if v, ok := reqcc["max-stale"]; ok {
+		if v == "" {
+			return true
+		}
+		if d, ok := reqcc.Seconds("max-stale"); ok && age-lifetime <= d {
+			return true
+		}
+	}
+
+	return false
+}
+
+// notModified evaluates the conditionals of req against the validators of the
+// stored resp, RFC 7232 section 6.
+func notModified(req *http.Request, resp *http.Response) bool {
+	if values := req.Header["If-None-Match"]; len(values) > 0 {
+		etag := strings.TrimPrefix(resp.Header.Get("Etag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(strings.Join(values, ","), ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lm.After(ims)
+}
@@ -0,0 +1,168 @@
+package cache
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		cc     cacheControl
+	}{
+		{"empty", nil, cacheControl{}},
+		{"flags", []string{"no-cache, no-store"}, cacheControl{"no-cache": "", "no-store": ""}},
+		{"values", []string{"max-age=60, s-maxage=\"120\""}, cacheControl{"max-age": "60", "s-maxage": "120"}},
+		{"case and spaces", []string{" Max-Age = 60 ,,Public"}, cacheControl{"max-age": "60", "public": ""}},
+		{"several headers", []string{"private", "max-stale"}, cacheControl{"private": "", "max-stale": ""}},
+	}
+
+	for _, tt := range tests {
+		cc := parseCacheControl(http.Header{"Cache-Control": tt.values})
+		if !reflect.DeepEqual(cc, tt.cc) {
+			t.Errorf("%s: parseCacheControl(%q) = %v, want %v", tt.name, tt.values, cc, tt.cc)
+		}
+	}
+
+	cc := parseCacheControl(http.Header{"Cache-Control": {"max-age=60, max-stale=-1, min-fresh=x"}})
+	if d, ok := cc.Seconds("max-age"); !ok || d != time.Minute {
+		t.Errorf("Seconds(max-age) = %v, %v, want %v, true", d, ok, time.Minute)
+	}
+	for _, name := range []string{"max-stale", "min-fresh", "no-cache"} {
+		if d, ok := cc.Seconds(name); ok {
+			t.Errorf("Seconds(%s) = %v, true, want false", name, d)
+		}
+	}
+}
+
+func TestStorable(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		reqh     http.Header
+		status   int
+		resph    http.Header
+		storable bool
+	}{
+		{"max-age", "GET", nil, 200, http.Header{"Cache-Control": {"max-age=60"}}, true},
+		{"expires", "GET", nil, 200, http.Header{"Expires": {"Thu, 01 Jan 2037 00:00:00 GMT"}}, true},
+		{"last-modified", "GET", nil, 404, http.Header{"Last-Modified": {"Thu, 01 Jan 2015 00:00:00 GMT"}}, true},
+		{"etag", "GET", nil, 301, http.Header{"Etag": {"\"v1\""}}, true},
+		{"no validators", "GET", nil, 200, http.Header{}, false},
+		{"post", "POST", nil, 200, http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{"partial", "GET", nil, 206, http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{"request no-store", "GET", http.Header{"Cache-Control": {"no-store"}}, 200, http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{"response no-store", "GET", nil, 200, http.Header{"Cache-Control": {"max-age=60, no-store"}}, false},
+		{"private", "GET", nil, 200, http.Header{"Cache-Control": {"private, max-age=60"}}, false},
+		{"authorization", "GET", http.Header{"Authorization": {"Basic eA=="}}, 200, http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{"authorization public", "GET", http.Header{"Authorization": {"Basic eA=="}}, 200, http.Header{"Cache-Control": {"public, max-age=60"}}, true},
+		{"set-cookie", "GET", nil, 200, http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}}, false},
+		{"vary star", "GET", nil, 200, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, false},
+	}
+
+	for _, tt := range tests {
+		req := &http.Request{Method: tt.method, Header: tt.reqh}
+		if req.Header == nil {
+			req.Header = http.Header{}
+		}
+		resp := &http.Response{StatusCode: tt.status, Header: tt.resph}
+		if got := storable(req, resp); got != tt.storable {
+			t.Errorf("%s: storable() = %v, want %v", tt.name, got, tt.storable)
+		}
+	}
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	date := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		header   http.Header
+		lifetime time.Duration
+	}{
+		{"max-age", http.Header{"Cache-Control": {"max-age=60"}}, time.Minute},
+		{"s-maxage over max-age", http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, 2 * time.Minute},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache, max-age=60"}}, 0},
+		{"max-age over expires", http.Header{"Cache-Control": {"max-age=60"}, "Date": {date.Format(http.TimeFormat)}, "Expires": {date.Add(time.Hour).Format(http.TimeFormat)}}, time.Minute},
+		{"expires", http.Header{"Date": {date.Format(http.TimeFormat)}, "Expires": {date.Add(time.Hour).Format(http.TimeFormat)}}, time.Hour},
+		{"expires in the past", http.Header{"Date": {date.Format(http.TimeFormat)}, "Expires": {date.Add(-time.Hour).Format(http.TimeFormat)}}, 0},
+		{"invalid expires", http.Header{"Date": {date.Format(http.TimeFormat)}, "Expires": {"0"}}, 0},
+		{"heuristic", http.Header{"Date": {date.Format(http.TimeFormat)}, "Last-Modified": {date.Add(-10 * time.Hour).Format(http.TimeFormat)}}, time.Hour},
+		{"heuristic limit", http.Header{"Date": {date.Format(http.TimeFormat)}, "Last-Modified": {date.Add(-1000 * time.Hour).Format(http.TimeFormat)}}, 24 * time.Hour},
+		{"none", http.Header{"Date": {date.Format(http.TimeFormat)}}, 0},
+	}
+
+	for _, tt := range tests {
+		if got := freshnessLifetime(&http.Response{Header: tt.header}); got != tt.lifetime {
+			t.Errorf("%s: freshnessLifetime() = %v, want %v", tt.name, got, tt.lifetime)
+		}
+	}
+}
+
+func TestFresh(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		reqh   http.Header
+		resph  http.Header
+		stored time.Duration
+		fresh  bool
+	}{
+		{"fresh", nil, http.Header{"Cache-Control": {"max-age=60"}}, 30 * time.Second, true},
+		{"stale", nil, http.Header{"Cache-Control": {"max-age=60"}}, 90 * time.Second, false},
+		{"age header", nil, http.Header{"Cache-Control": {"max-age=60"}, "Age": {"50"}}, 30 * time.Second, false},
+		{"request no-cache", http.Header{"Cache-Control": {"no-cache"}}, http.Header{"Cache-Control": {"max-age=60"}}, 0, false},
+		{"pragma no-cache", http.Header{"Pragma": {"no-cache"}}, http.Header{"Cache-Control": {"max-age=60"}}, 0, false},
+		{"request max-age", http.Header{"Cache-Control": {"max-age=10"}}, http.Header{"Cache-Control": {"max-age=60"}}, 30 * time.Second, false},
+		{"min-fresh", http.Header{"Cache-Control": {"min-fresh=40"}}, http.Header{"Cache-Control": {"max-age=60"}}, 30 * time.Second, false},
+		{"max-stale", http.Header{"Cache-Control": {"max-stale=60"}}, http.Header{"Cache-Control": {"max-age=60"}}, 90 * time.Second, true},
+		{"max-stale exceeded", http.Header{"Cache-Control": {"max-stale=10"}}, http.Header{"Cache-Control": {"max-age=60"}}, 90 * time.Second, false},
+		{"max-stale any", http.Header{"Cache-Control": {"max-stale"}}, http.Header{"Cache-Control": {"max-age=60"}}, time.Hour, true},
+		{"must-revalidate", http.Header{"Cache-Control": {"max-stale"}}, http.Header{"Cache-Control": {"max-age=60, must-revalidate"}}, 90 * time.Second, false},
+	}
+
+	for _, tt := range tests {
+		req := &http.Request{Header: tt.reqh}
+		if req.Header == nil {
+			req.Header = http.Header{}
+		}
+		resp := &http.Response{Header: tt.resph}
+		if got := fresh(req, resp, now.Add(-tt.stored)); got != tt.fresh {
+			t.Errorf("%s: fresh() = %v, want %v", tt.name, got, tt.fresh)
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	lm := "Thu, 01 Jan 2015 00:00:00 GMT"
+
+	tests := []struct {
+		name        string
+		reqh        http.Header
+		resph       http.Header
+		notModified bool
+	}{
+		{"etag", http.Header{"If-None-Match": {"\"v1\""}}, http.Header{"Etag": {"\"v1\""}}, true},
+		{"etag list", http.Header{"If-None-Match": {"\"v0\", W/\"v1\""}}, http.Header{"Etag": {"\"v1\""}}, true},
+		{"etag star", http.Header{"If-None-Match": {"*"}}, http.Header{"Etag": {"\"v1\""}}, true},
+		{"etag changed", http.Header{"If-None-Match": {"\"v0\""}}, http.Header{"Etag": {"\"v1\""}}, false},
+		{"no etag", http.Header{"If-None-Match": {"\"v1\""}}, http.Header{"Last-Modified": {lm}}, false},
+		{"etag over date", http.Header{"If-None-Match": {"\"v0\""}, "If-Modified-Since": {lm}}, http.Header{"Etag": {"\"v1\""}, "Last-Modified": {lm}}, false},
+		{"not modified since", http.Header{"If-Modified-Since": {lm}}, http.Header{"Last-Modified": {lm}}, true},
+		{"modified since", http.Header{"If-Modified-Since": {"Wed, 31 Dec 2014 00:00:00 GMT"}}, http.Header{"Last-Modified": {lm}}, false},
+		{"no last-modified", http.Header{"If-Modified-Since": {lm}}, http.Header{}, false},
+		{"unconditional", http.Header{}, http.Header{"Etag": {"\"v1\""}, "Last-Modified": {lm}}, false},
+	}
+
+	for _, tt := range tests {
+		req := &http.Request{Header: tt.reqh}
+		resp := &http.Response{Header: tt.resph}
+		if got := notModified(req, resp); got != tt.notModified {
+			t.Errorf("%s: notModified() = %v, want %v", tt.name, got, tt.notModified)
+		}
+	}
+}
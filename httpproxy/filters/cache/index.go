@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+type indexEntry struct {
+	name string
+	size int64
+}
+
+// Index tracks the size of stored objects and evicts the least recently
+// used ones once MaxSize is exceeded.
+type Index struct {
+	MaxSize  int64
+	Evict    func(name string)
+	mu       sync.Mutex
+	size     int64
+	ll       *list.List
+	elements map[string]*list.Element
+}
+
+func NewIndex(maxSize int64, evict func(name string)) *Index {
+	return &Index{
+		MaxSize:  maxSize,
+		Evict:    evict,
+		ll:       list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+// Touch marks name as recently used, it returns false if name is unknown.
+func (x *Index) Touch(name string) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if e, ok := x.elements[name]; ok {
+		x.ll.MoveToFront(e)
+		return true
+	}
+	return false
+}
+
+// Has reports whether name is indexed, without marking it as used.
+func (x *Index) Has(name string) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	_, ok := x.elements[name]
+	return ok
+}
+
+// Add records name with size as the most recently used object.
+func (x *Index) Add(name string, size int64) {
+	x.mu.Lock()
+	if e, ok := x.elements[name]; ok {
+		x.size += size - e.Value.(*indexEntry).size
+		e.Value.(*indexEntry).size = size
+		x.ll.MoveToFront(e)
+	} else {
+		x.elements[name] = x.ll.PushFront(&indexEntry{name, size})
+		x.size += size
+	}
+
+	evicted := make([]string, 0)
+	for x.MaxSize > 0 && x.size > x.MaxSize && x.ll.Len() > 1 {
+		e := x.ll.Back()
+		entry := e.Value.(*indexEntry)
+		x.ll.Remove(e)
+		delete(x.elements, entry.name)
+		x.size -= entry.size
+		evicted = append(evicted, entry.name)
+	}
+	x.mu.Unlock()
+
+	if x.Evict != nil {
+		for _, name := range evicted {
+			x.Evict(name)
+		}
+	}
+}
+
+func (x *Index) Remove(name string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if e, ok := x.elements[name]; ok {
+		x.ll.Remove(e)
+		delete(x.elements, name)
+		x.size -= e.Value.(*indexEntry).size
+	}
+}
+
+// Size returns the total size and count of indexed objects.
+func (x *Index) Size() (int64, int) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.size, x.ll.Len()
+}
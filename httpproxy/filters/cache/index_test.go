@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	type op struct {
+		action string
+		name   string
+		size   int64
+	}
+
+	tests := []struct {
+		name    string
+		maxSize int64
+		ops     []op
+		evicted []string
+		size    int64
+		count   int
+	}{
+		{"under limit", 100, []op{{"add", "a", 40}, {"add", "b", 40}}, nil, 80, 2},
+		{"evict oldest", 100, []op{{"add", "a", 40}, {"add", "b", 40}, {"add", "c", 40}}, []string{"a"}, 80, 2},
+		{"touch keeps", 100, []op{{"add", "a", 40}, {"add", "b", 40}, {"touch", "a", 0}, {"add", "c", 40}}, []string{"b"}, 80, 2},
+		{"evict several", 100, []op{{"add", "a", 40}, {"add", "b", 40}, {"add", "c", 90}}, []string{"a", "b"}, 90, 1},
+		{"keep the newest", 100, []op{{"add", "a", 40}, {"add", "b", 200}}, []string{"a"}, 200, 1},
+		{"resize", 100, []op{{"add", "a", 40}, {"add", "b", 40}, {"add", "a", 70}}, []string{"b"}, 70, 1},
+		{"remove", 100, []op{{"add", "a", 40}, {"add", "b", 40}, {"remove", "a", 0}, {"add", "c", 40}}, nil, 80, 2},
+		{"unlimited", 0, []op{{"add", "a", 400}, {"add", "b", 400}}, nil, 800, 2},
+	}
+
+	for _, tt := range tests {
+		var evicted []string
+		x := NewIndex(tt.maxSize, func(name string) {
+			evicted = append(evicted, name)
+		})
+		for _, o := range tt.ops {
+			switch o.action {
+			case "add":
+				x.Add(o.name, o.size)
+			case "touch":
+				if !x.Touch(o.name) {
+					t.Errorf("%s: Touch(%q) = false", tt.name, o.name)
+				}
+			case "remove":
+				x.Remove(o.name)
+			}
+		}
+		if !reflect.DeepEqual(evicted, tt.evicted) {
+			t.Errorf("%s: evicted %q, want %q", tt.name, evicted, tt.evicted)
+		}
+		if size, count := x.Size(); size != tt.size || count != tt.count {
+			t.Errorf("%s: Size() = %d, %d, want %d, %d", tt.name, size, count, tt.size, tt.count)
+		}
+		for _, name := range evicted {
+			if x.Has(name) || x.Touch(name) {
+				t.Errorf("%s: evicted %q is still indexed", tt.name, name)
+			}
+		}
+	}
+}
@@ -1,10 +1,14 @@
 package filters
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -17,13 +21,29 @@ func (v VenderKey) String() string {
 	return string(v)
 }
 
+// Context carries the state of a request through the filters. Its Context
+// method returns the context.Context of the current filter, which is done when
+// the client goes away, the request is killed, or the filter times out.
 type Context struct {
-	ln           net.Listener
-	rw           http.ResponseWriter
-	venderString string
-	venderValues map[VenderKey]string
-	values       map[string]interface{}
-	hijacked     bool
+	ln              net.Listener
+	rw              http.ResponseWriter
+	venderString    string
+	venderValues    map[VenderKey]string
+	values          map[string]interface{}
+	hijacked        bool
+	route           string
+	roundTripFilter RoundTripFilter
+	muInfo          sync.Mutex
+	username        string
+	upstream        string
+	muClosers       sync.Mutex
+	closers         []io.Closer
+	killed          bool
+	muCtx           sync.Mutex
+	base            context.Context
+	ctx             context.Context
+	cancel          context.CancelFunc
+	cancelTimeout   context.CancelFunc
 }
 
 func NewContext(ln net.Listener, rw http.ResponseWriter, req *http.Request) *Context {
@@ -33,6 +53,8 @@ func NewContext(ln net.Listener, rw http.ResponseWriter, req *http.Request) *Con
 	c.values = make(map[string]interface{})
 	c.venderString = req.Header.Get(VenderHeader)
 	c.venderValues = make(map[VenderKey]string)
+	c.base, c.cancel = context.WithCancel(req.Context())
+	c.ctx = c.base
 
 	if c.venderString != "" {
 		for _, part := range strings.Split(strings.TrimSpace(c.venderString), ";") {
@@ -46,6 +68,41 @@ func NewContext(ln net.Listener, rw http.ResponseWriter, req *http.Request) *Con
 	return &c
 }
 
+func (c *Context) current() context.Context {
+	c.muCtx.Lock()
+	defer c.muCtx.Unlock()
+	return c.ctx
+}
+
+// Context returns the context.Context of the current filter, requests and
+// dials of the filter should carry it. It is a snapshot, the next SetTimeout
+// does not change it.
+func (c *Context) Context() context.Context {
+	return c.current()
+}
+
+// SetTimeout starts a deadline of d for the next filter, replacing the one of
+// the previous filter, zero means no deadline. The deadline covers reading
+// the response body too.
+func (c *Context) SetTimeout(d time.Duration) {
+	c.muCtx.Lock()
+	defer c.muCtx.Unlock()
+	if c.cancelTimeout != nil {
+		c.cancelTimeout()
+		c.cancelTimeout = nil
+	}
+	c.ctx = c.base
+	if d > 0 {
+		c.ctx, c.cancelTimeout = context.WithTimeout(c.base, d)
+	}
+}
+
+// Cancel cancels the context of the request, it is called when the request
+// finished.
+func (c *Context) Cancel() {
+	c.cancel()
+}
+
 func (c *Context) SetString(name string, value string) {
 	c.set(name, value)
 }
@@ -133,3 +190,67 @@ func (c *Context) SetHijacked(hijacked bool) {
 func (c *Context) Hijacked() bool {
 	return c.hijacked
 }
+
+// SetRoute records the routing rule and the RoundTripFilter it dispatched to.
+func (c *Context) SetRoute(name string, f RoundTripFilter) {
+	c.route = name
+	c.roundTripFilter = f
+}
+
+func (c *Context) GetRoute() string {
+	return c.route
+}
+
+func (c *Context) GetRoundTripFilter() RoundTripFilter {
+	return c.roundTripFilter
+}
+
+// SetUsername records the authenticated user, it may be read by the admin
+// api while the request is in flight.
+func (c *Context) SetUsername(username string) {
+	c.muInfo.Lock()
+	defer c.muInfo.Unlock()
+	c.username = username
+}
+
+func (c *Context) GetUsername() string {
+	c.muInfo.Lock()
+	defer c.muInfo.Unlock()
+	return c.username
+}
+
+// SetUpstream records the address the request was sent to, for access logs.
+func (c *Context) SetUpstream(upstream string) {
+	c.muInfo.Lock()
+	defer c.muInfo.Unlock()
+	c.upstream = upstream
+}
+
+func (c *Context) GetUpstream() string {
+	c.muInfo.Lock()
+	defer c.muInfo.Unlock()
+	return c.upstream
+}
+
+// AddCloser registers a connection of the request, it is closed by Kill.
+func (c *Context) AddCloser(closer io.Closer) {
+	c.muClosers.Lock()
+	defer c.muClosers.Unlock()
+	if c.killed {
+		closer.Close()
+		return
+	}
+	c.closers = append(c.closers, closer)
+}
+
+// Kill cancels the request and closes its registered connections.
+func (c *Context) Kill() {
+	c.cancel()
+	c.muClosers.Lock()
+	defer c.muClosers.Unlock()
+	c.killed = true
+	for _, closer := range c.closers {
+		closer.Close()
+	}
+	c.closers = nil
+}
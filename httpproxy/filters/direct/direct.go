@@ -2,8 +2,8 @@ package direct
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
-	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -12,7 +12,6 @@ import (
 	"github.com/golang/glog"
 
 	"../../../httpproxy"
-	"../../../storage"
 	"../../filters"
 	"../../transport/direct"
 )
@@ -36,25 +35,30 @@ type Config struct {
 		DisableCompression  bool
 		TLSHandshakeTimeout int
 		MaxIdleConnsPerHost int
+		EnableHTTP2         bool
+	}
+	Tunnel struct {
+		IdleTimeout int
+		Timeout     int
 	}
 }
 
 type Filter struct {
+	name string
 	filters.RoundTripFilter
 	transport *http.Transport
+	dialer    *direct.Dialer
+	relay     *httpproxy.Relay
 }
 
 func init() {
-	filename := filterName + ".json"
-	config := new(Config)
-	err := storage.ReadJsonConfig(filters.LookupConfigStoreURI(filterName), filename, config)
-	if err != nil {
-		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
-	}
-
-	err = filters.Register(filterName, &filters.RegisteredFilter{
-		New: func() (filters.Filter, error) {
-			return NewFilter(config)
+	err := filters.Register(filterName, &filters.RegisteredFilter{
+		New: func(name string) (filters.Filter, error) {
+			config := new(Config)
+			if err := filters.ReadConfig(name, config); err != nil {
+				return nil, err
+			}
+			return NewFilter(name, config)
 		},
 	})
 
@@ -63,7 +67,7 @@ func init() {
 	}
 }
 
-func NewFilter(config *Config) (filters.Filter, error) {
+func NewFilter(name string, config *Config) (filters.Filter, error) {
 	d := &direct.Dialer{
 		Dialer: net.Dialer{
 			KeepAlive: time.Duration(config.Transport.Dialer.KeepAlive) * time.Second,
@@ -77,7 +81,7 @@ func NewFilter(config *Config) (filters.Filter, error) {
 	}
 
 	tr := &http.Transport{
-		Dial: d.Dial,
+		DialContext: d.DialContext,
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: false,
 			ClientSessionCache: tls.NewLRUClientSessionCache(1000),
@@ -85,56 +89,92 @@ func NewFilter(config *Config) (filters.Filter, error) {
 		TLSHandshakeTimeout: time.Duration(config.Transport.TLSHandshakeTimeout) * time.Second,
 		MaxIdleConnsPerHost: config.Transport.MaxIdleConnsPerHost,
 		DisableCompression:  config.Transport.DisableCompression,
+		ForceAttemptHTTP2:   config.Transport.EnableHTTP2,
 	}
 
 	return &Filter{
+		name:      name,
 		transport: tr,
+		dialer:    d,
+		relay: &httpproxy.Relay{
+			IdleTimeout: time.Duration(config.Tunnel.IdleTimeout) * time.Second,
+			Timeout:     time.Duration(config.Tunnel.Timeout) * time.Second,
+		},
 	}, nil
 }
 
 func (f *Filter) FilterName() string {
-	return filterName
+	return f.name
+}
+
+func (f *Filter) Close(ctx context.Context) error {
+	f.transport.CloseIdleConnections()
+	return nil
+}
+
+func (f *Filter) ServeAdmin(rw http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.URL.Path == "/flush-dns" && req.Method == "POST":
+		httpproxy.WriteJSON(rw, http.StatusOK, map[string]int{"Flushed": f.dialer.ClearDNSCache()})
+	default:
+		http.NotFound(rw, req)
+	}
 }
 
 func (f *Filter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Response, error) {
 	switch req.Method {
 	case "CONNECT":
-		glog.Infof("%s \"DIRECT %s %s %s\" - -", req.RemoteAddr, req.Method, req.Host, req.Proto)
-		rconn, err := f.transport.Dial("tcp", req.Host)
+		rconn, err := f.dialer.DialContext(ctx.Context(), "tcp", req.Host)
 		if err != nil {
 			return ctx, nil, err
 		}
+		ctx.SetUpstream(rconn.RemoteAddr().String())
+		ctx.AddCloser(rconn)
 
-		rw := ctx.GetResponseWriter()
+		defer rconn.Close()
 
-		hijacker, ok := rw.(http.Hijacker)
-		if !ok {
-			return ctx, nil, fmt.Errorf("http.ResponseWriter(%#v) does not implments http.Hijacker", rw)
-		}
-
-		flusher, ok := rw.(http.Flusher)
-		if !ok {
-			return ctx, nil, fmt.Errorf("http.ResponseWriter(%#v) does not implments http.Flusher", rw)
-		}
-
-		rw.WriteHeader(http.StatusOK)
-		flusher.Flush()
-
-		lconn, _, err := hijacker.Hijack()
+		lconn, err := httpproxy.HijackConnect(ctx.GetResponseWriter(), req)
 		if err != nil {
-			return ctx, nil, fmt.Errorf("%#v.Hijack() error: %v", hijacker, err)
+			return ctx, nil, err
 		}
 		defer lconn.Close()
 
-		go httpproxy.IoCopy(rconn, lconn)
-		httpproxy.IoCopy(lconn, rconn)
+		f.relay.Copy(lconn, rconn)
 
 		ctx.SetHijacked(true)
 		return ctx, nil, nil
 	case "PRI":
-		//TODO: fix for http2
-		return ctx, nil, nil
+		// A h2c preface is meant for the proxy itself, ask the client to use HTTP/1.1 or TLS
+		data := "HTTP/2 with prior knowledge is not supported"
+		resp := &http.Response{
+			Status:        "505 HTTP Version Not Supported",
+			StatusCode:    http.StatusHTTPVersionNotSupported,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{},
+			Request:       req,
+			Close:         true,
+			ContentLength: int64(len(data)),
+			Body:          ioutil.NopCloser(bytes.NewReader([]byte(data))),
+		}
+		return ctx, resp, nil
 	default:
+		if httpproxy.IsUpgrade(req) {
+			rconn, err := httpproxy.DialUpgrade(req, f.dialer.DialContext, &tls.Config{ClientSessionCache: f.transport.TLSClientConfig.ClientSessionCache})
+			if err != nil {
+				return ctx, nil, err
+			}
+			ctx.SetUpstream(rconn.RemoteAddr().String())
+			ctx.AddCloser(rconn)
+			resp, err := httpproxy.Upgrade(ctx.GetResponseWriter(), req, rconn, f.relay)
+			if err == nil && resp == nil {
+				ctx.SetHijacked(true)
+			}
+			return ctx, resp, err
+		}
+
+		ctx.SetUpstream(req.URL.Host)
 		resp, err := f.transport.RoundTrip(req)
 
 		if err != nil {
@@ -153,10 +193,6 @@ func (f *Filter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Co
 				Body:          ioutil.NopCloser(bytes.NewReader([]byte(data))),
 			}
 			err = nil
-		} else {
-			if req.RemoteAddr != "" {
-				glog.Infof("%s \"DIRECT %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
-			}
 		}
 		return ctx, resp, err
 	}
@@ -1,9 +1,15 @@
 package filters
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
+
+	"../../storage"
 )
 
 const (
@@ -13,6 +19,8 @@ const (
 )
 
 type Filter interface {
+	// FilterName returns the name the filter is created with, "type" or
+	// "type:instance"
 	FilterName() string
 }
 
@@ -31,17 +39,73 @@ type ResponseFilter interface {
 	Response(*Context, *http.Response) (*Context, *http.Response, error)
 }
 
+// RoundTripHandler produces the response of a request, for a MiddlewareFilter
+// it is the rest of the chain
+type RoundTripHandler func(*Context, *http.Request) (*Context, *http.Response, error)
+
+// MiddlewareFilter wraps the rest of the chain, it may decorate the request,
+// call next, and then inspect, retry or rewrite the response
+type MiddlewareFilter interface {
+	FilterName() string
+	Handle(ctx *Context, req *http.Request, next RoundTripHandler) (*Context, *http.Response, error)
+}
+
+// Starter is implemented by filters with background work, Start is called once
+// before the filter serves and must not block, the work stops when ctx is done
+// or the filter is closed.
+type Starter interface {
+	Start(ctx context.Context) error
+}
+
+// Closer is implemented by filters holding goroutines, connections or files,
+// Close is called when the filter is dropped and releases them before ctx is
+// done. In-flight requests of an old chain may still use a closed filter.
+type Closer interface {
+	Close(ctx context.Context) error
+}
+
 type RegisteredFilter struct {
-	New func() (Filter, error)
+	// New creates a filter instance, name is "type" or "type:instance"
+	New func(name string) (Filter, error)
+}
+
+// registry holds the filters created by GetFilter, deps records the transports
+// each one got by GetTransport
+type registry struct {
+	filters map[string]Filter
+	started map[string]bool
+	configs map[string]interface{}
+	deps    map[string][]string
+}
+
+func newRegistry() *registry {
+	return &registry{
+		filters: make(map[string]Filter),
+		started: make(map[string]bool),
+		configs: make(map[string]interface{}),
+		deps:    make(map[string][]string),
+	}
 }
 
 var (
 	registeredFilters map[string]*RegisteredFilter
-	filters           map[string]Filter
+	// live is the registry in use, pending is the one being built by a reload
+	live      *registry
+	pending   *registry
+	muFilters sync.Mutex
 )
 
 func init() {
 	registeredFilters = make(map[string]*RegisteredFilter)
+	live = newRegistry()
+}
+
+// current returns the registry GetFilter works on, muFilters must be held
+func current() *registry {
+	if pending != nil {
+		return pending
+	}
+	return live
 }
 
 // Register a Filter
@@ -72,20 +136,299 @@ func LookupConfigStoreURI(filterName string) string {
 	return "file://."
 }
 
-// NewFilter creates a new Filter of type "name"
+// SplitName splits a filter name "type:instance" to type and instance
+func SplitName(name string) (filterType string, instance string) {
+	parts := strings.SplitN(name, ":", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return name, ""
+}
+
+// ReadConfig reads "type.json" or "type.instance.json" of filter name to config
+func ReadConfig(name string, config interface{}) error {
+	filterType, instance := SplitName(name)
+
+	filename := filterType + ".json"
+	if instance != "" {
+		filename = filterType + "." + instance + ".json"
+	}
+
+	err := storage.ReadJsonConfig(LookupConfigStoreURI(filterType), filename, config)
+	if err != nil {
+		return fmt.Errorf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	muFilters.Lock()
+	current().configs[name] = config
+	muFilters.Unlock()
+	return nil
+}
+
+// GetConfig returns the config last read by ReadConfig for filter name
+func GetConfig(name string) interface{} {
+	muFilters.Lock()
+	defer muFilters.Unlock()
+	return live.configs[name]
+}
+
+// NewFilter creates a new Filter of "type" or "type:instance"
 func NewFilter(name string) (Filter, error) {
-	filter, exists := registeredFilters[name]
+	filterType, _ := SplitName(name)
+	filter, exists := registeredFilters[filterType]
 	if !exists {
 		return nil, fmt.Errorf("registeredFilters: Unknown filter %q", name)
 	}
-	return filter.New()
+	return filter.New(name)
 }
 
-// GetFilter try get a existing Filter of type "name", otherwise create new one
+// GetFilter try get a existing Filter of "name", otherwise create and keep a new one
 func GetFilter(name string) (Filter, error) {
-	filter, exists := filters[name]
+	muFilters.Lock()
+	r := current()
+	filter, exists := r.filters[name]
+	muFilters.Unlock()
 	if exists {
 		return filter, nil
 	}
-	return NewFilter(name)
+
+	// filters may get their transport filters in New, so do not hold the lock
+	filter, err := NewFilter(name)
+	if err != nil {
+		return nil, err
+	}
+
+	muFilters.Lock()
+	defer muFilters.Unlock()
+	if filter1, exists := r.filters[name]; exists {
+		return filter1, nil
+	}
+	r.filters[name] = filter
+	return filter, nil
+}
+
+// GetTransport is GetFilter for the transport of the filter name, called in
+// its New, it records the dependency so that a reload keeps the transport as
+// long as name is used.
+func GetTransport(name, transport string) (Filter, error) {
+	filter, err := GetFilter(transport)
+	if err != nil {
+		return nil, err
+	}
+
+	muFilters.Lock()
+	defer muFilters.Unlock()
+	r := current()
+	r.deps[name] = append(r.deps[name], transport)
+	return filter, nil
+}
+
+// Filters returns a snapshot of existing filters by name
+func Filters() map[string]Filter {
+	muFilters.Lock()
+	defer muFilters.Unlock()
+	m := make(map[string]Filter, len(live.filters))
+	for name, filter := range live.filters {
+		m[name] = filter
+	}
+	return m
+}
+
+// BeginFilters starts a new registry, GetFilter and StartFilters work on it
+// until CommitFilters or AbortFilters, while Filters still returns the old ones
+func BeginFilters() {
+	muFilters.Lock()
+	defer muFilters.Unlock()
+	pending = newRegistry()
+}
+
+// CommitFilters makes the registry of BeginFilters the live one, and returns
+// the old filters to be closed, except keep and the filters they depend on
+func CommitFilters(keep []string) map[string]Filter {
+	muFilters.Lock()
+	defer muFilters.Unlock()
+	if pending == nil {
+		return nil
+	}
+	old := live
+	live, pending = pending, nil
+
+	unused := make(map[string]Filter, len(old.filters))
+	for name, filter := range old.filters {
+		unused[name] = filter
+	}
+	for len(keep) > 0 {
+		name := keep[len(keep)-1]
+		keep = keep[:len(keep)-1]
+		if _, ok := unused[name]; ok {
+			delete(unused, name)
+			keep = append(keep, old.deps[name]...)
+		}
+	}
+	return unused
+}
+
+// AbortFilters drops the registry of BeginFilters and returns its filters to
+// be closed, the live ones are untouched
+func AbortFilters() map[string]Filter {
+	muFilters.Lock()
+	defer muFilters.Unlock()
+	if pending == nil {
+		return nil
+	}
+	fs := pending.filters
+	pending = nil
+	return fs
+}
+
+// StartFilters starts the existing filters which are not started yet
+func StartFilters(ctx context.Context) error {
+	muFilters.Lock()
+	r := current()
+	starters := make(map[string]Starter)
+	for name, filter := range r.filters {
+		if r.started[name] {
+			continue
+		}
+		r.started[name] = true
+		if s, ok := filter.(Starter); ok {
+			starters[name] = s
+		}
+	}
+	muFilters.Unlock()
+
+	for name, s := range starters {
+		if err := s.Start(ctx); err != nil {
+			return fmt.Errorf("filter %#v Start() failed: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// CloseFilters closes fs, it tries all of them and returns the first error
+func CloseFilters(ctx context.Context, fs map[string]Filter) error {
+	var err error
+	for name, filter := range fs {
+		if c, ok := filter.(Closer); ok {
+			if err1 := c.Close(ctx); err1 != nil && err == nil {
+				err = fmt.Errorf("filter %#v Close() failed: %s", name, err1)
+			}
+		}
+	}
+	return err
+}
+
+// RoundTripper adapts a RoundTripFilter to http.RoundTripper, so that a filter
+// can be used as the transport of other components
+type RoundTripper struct {
+	Filter RoundTripFilter
+}
+
+func (t *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return RoundTrip(t.Filter, req)
+}
+
+// RoundTrip sends req through f outside of a Handler, the Context of f is
+// cancelled once the response body is closed.
+func RoundTrip(f RoundTripFilter, req *http.Request) (*http.Response, error) {
+	ctx := NewContext(nil, nil, req)
+	_, resp, err := f.RoundTrip(ctx, req)
+	if err == nil && resp == nil {
+		err = fmt.Errorf("%s does not handle %s %s", f.FilterName(), req.Method, req.URL.String())
+	}
+	if err != nil || resp.Body == nil {
+		ctx.Cancel()
+		return resp, err
+	}
+	resp.Body = &cancelBody{resp.Body, ctx}
+	return resp, nil
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	ctx *Context
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.ctx.Cancel()
+	return err
+}
+
+// Middleware returns f as a MiddlewareFilter, a RoundTripFilter, RequestFilter
+// or ResponseFilter is adapted in that order of preference
+func Middleware(f Filter) (MiddlewareFilter, error) {
+	switch f1 := f.(type) {
+	case MiddlewareFilter:
+		return f1, nil
+	case RoundTripFilter:
+		return &roundTripMiddleware{f1}, nil
+	case RequestFilter:
+		return &requestMiddleware{f1}, nil
+	case ResponseFilter:
+		return &responseMiddleware{f1}, nil
+	}
+	return nil, fmt.Errorf("%#v is not a MiddlewareFilter", f)
+}
+
+// Wrap returns next wrapped by middlewares, the first one is the outermost
+func Wrap(middlewares []MiddlewareFilter, next RoundTripHandler) RoundTripHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		m, next1 := middlewares[i], next
+		next = func(ctx *Context, req *http.Request) (*Context, *http.Response, error) {
+			return m.Handle(ctx, req, next1)
+		}
+	}
+	return next
+}
+
+// roundTripMiddleware calls next if the filter neither responds nor hijacks
+type roundTripMiddleware struct {
+	RoundTripFilter
+}
+
+func (m *roundTripMiddleware) Unwrap() Filter {
+	return m.RoundTripFilter
+}
+
+func (m *roundTripMiddleware) Handle(ctx *Context, req *http.Request, next RoundTripHandler) (*Context, *http.Response, error) {
+	ctx, resp, err := m.RoundTrip(ctx, req)
+	if err != nil || resp != nil || ctx.Hijacked() {
+		return ctx, resp, err
+	}
+	return next(ctx, req)
+}
+
+// requestMiddleware calls next with the request returned by the filter
+type requestMiddleware struct {
+	RequestFilter
+}
+
+func (m *requestMiddleware) Unwrap() Filter {
+	return m.RequestFilter
+}
+
+func (m *requestMiddleware) Handle(ctx *Context, req *http.Request, next RoundTripHandler) (*Context, *http.Response, error) {
+	ctx, req, err := m.Request(ctx, req)
+	if err != nil || ctx.Hijacked() {
+		return ctx, nil, err
+	}
+	return next(ctx, req)
+}
+
+// responseMiddleware filters the response returned by next
+type responseMiddleware struct {
+	ResponseFilter
+}
+
+func (m *responseMiddleware) Unwrap() Filter {
+	return m.ResponseFilter
+}
+
+func (m *responseMiddleware) Handle(ctx *Context, req *http.Request, next RoundTripHandler) (*Context, *http.Response, error) {
+	ctx, resp, err := next(ctx, req)
+	if err != nil || resp == nil || ctx.Hijacked() {
+		return ctx, resp, err
+	}
+	return m.Response(ctx, resp)
 }
@@ -0,0 +1,214 @@
+package gae
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"../../../httpproxy"
+	"../../filters"
+)
+
+const (
+	autoRangeRetryTimes int = 3
+)
+
+type AutoRange struct {
+	Threads int
+	MaxSize int64
+	BufSize int
+	Sites   *httpproxy.HostMatcher
+	Suffixs []string
+}
+
+func (a *AutoRange) Match(req *http.Request) bool {
+	if a == nil || a.MaxSize <= 0 || req.Method != "GET" {
+		return false
+	}
+
+	if a.Sites.Match(req.Host) {
+		return true
+	}
+
+	name := path.Base(req.URL.Path)
+	for _, pattern := range a.Suffixs {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseRange parses a single "bytes=start-[end]" range, end is -1 if omitted.
+func parseRange(s string) (start, end int64, ok bool) {
+	if !strings.HasPrefix(s, "bytes=") || strings.Contains(s, ",") {
+		return 0, -1, false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(s, "bytes="), "-", 2)
+	if len(parts) != 2 {
+		return 0, -1, false
+	}
+
+	start, err := strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 64)
+	if err != nil {
+		return 0, -1, false
+	}
+
+	end = -1
+	if s1 := strings.TrimSpace(parts[1]); s1 != "" {
+		if end, err = strconv.ParseInt(s1, 10, 64); err != nil || end < start {
+			return 0, -1, false
+		}
+	}
+
+	return start, end, true
+}
+
+// parseContentRange parses "bytes start-end/length".
+func parseContentRange(s string) (start, end, length int64, ok bool) {
+	if _, err := fmt.Sscanf(s, "bytes %d-%d/%d", &start, &end, &length); err != nil {
+		return 0, 0, 0, false
+	}
+	if start > end || end >= length {
+		return 0, 0, 0, false
+	}
+	return start, end, length, true
+}
+
+type rangeResult struct {
+	data []byte
+	err  error
+}
+
+// autoRange fetches bytes [start, end] of req as MaxSize ranges over Threads
+// fetch servers concurrently, and streams them back in order.
+func (f *Filter) autoRange(req *http.Request, start, end int64) io.ReadCloser {
+	threads := f.AutoRange.Threads
+	if threads <= 0 {
+		threads = 1
+	}
+
+	pr, pw := io.Pipe()
+	quit := make(chan struct{})
+	queue := make(chan chan rangeResult, threads-1)
+
+	go func() {
+		defer close(queue)
+		n := 0
+		for pos := start; pos <= end; pos += f.AutoRange.MaxSize {
+			last := pos + f.AutoRange.MaxSize - 1
+			if last > end {
+				last = end
+			}
+			ch := make(chan rangeResult, 1)
+			select {
+			case queue <- ch:
+			case <-quit:
+				return
+			}
+			go func(n int, pos, last int64, ch chan<- rangeResult) {
+				data, err := f.fetchRange(req, n, pos, last)
+				ch <- rangeResult{data, err}
+			}(n, pos, last, ch)
+			n++
+		}
+	}()
+
+	go func() {
+		defer close(quit)
+		for ch := range queue {
+			r := <-ch
+			if r.err != nil {
+				glog.Warningf("%s \"GAE AUTORANGE %s %s %s\" error: %v", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, r.err)
+				pw.CloseWithError(r.err)
+				return
+			}
+			if _, err := pw.Write(r.data); err != nil {
+				return
+			}
+		}
+		pw.Close()
+	}()
+
+	return pr
+}
+
+// fetchRange runs concurrently with the others and the response, so it uses
+// its own Context rather than the one of the request.
+func (f *Filter) fetchRange(req *http.Request, n int, start, end int64) ([]byte, error) {
+	req1 := &http.Request{
+		Method:     req.Method,
+		URL:        req.URL,
+		Proto:      req.Proto,
+		ProtoMajor: req.ProtoMajor,
+		ProtoMinor: req.ProtoMinor,
+		Header:     http.Header{},
+		Host:       req.Host,
+		RemoteAddr: req.RemoteAddr,
+	}
+	for key, values := range req.Header {
+		req1.Header[key] = values
+	}
+	req1.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	req1 = req1.WithContext(req.Context())
+
+	var err error
+	for i := 0; i < autoRangeRetryTimes; i++ {
+		fetchServer := f.fetchServer(n + i)
+
+		var resp *http.Response
+		ctx := filters.NewContext(nil, nil, req1)
+		_, resp, err = f.fetch(ctx, req1, fetchServer)
+		if err != nil {
+			ctx.Cancel()
+			continue
+		}
+		if resp == nil {
+			ctx.Cancel()
+			err = fmt.Errorf("%s return nil response for %s", fetchServer.URL.String(), req1.Header.Get("Range"))
+			continue
+		}
+
+		data, err1 := readRange(resp, start, end, f.AutoRange.BufSize)
+		resp.Body.Close()
+		ctx.Cancel()
+		if err1 != nil {
+			err = err1
+			continue
+		}
+
+		return data, nil
+	}
+
+	return nil, err
+}
+
+func readRange(resp *http.Response, start, end int64, bufSize int) ([]byte, error) {
+	if resp.StatusCode != 206 {
+		return nil, fmt.Errorf("unexpected range response status: %s", resp.Status)
+	}
+
+	start1, end1, _, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if !ok || start1 != start || end1 != end {
+		return nil, fmt.Errorf("unexpected range response Content-Range: %#v", resp.Header.Get("Content-Range"))
+	}
+
+	if bufSize <= 0 {
+		bufSize = httpproxy.BUFSZ
+	}
+
+	data := make([]byte, end-start+1)
+	if _, err := io.ReadFull(bufio.NewReaderSize(resp.Body, bufSize), data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
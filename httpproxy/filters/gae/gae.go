@@ -7,20 +7,23 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
 
 	"github.com/golang/glog"
 
 	"../../../httpproxy"
-	"../../../storage"
 	"../../filters"
+	"../../metrics"
 )
 
 const (
 	filterName string = "gae"
 )
 
+var appidRotations = metrics.NewCounter("goproxy_gae_appid_rotations_total", "Appids rotated out after over quota 503 responses.")
+
 type Config struct {
 	AppIds    []string
 	Scheme    string
@@ -40,23 +43,22 @@ type Config struct {
 }
 
 type Filter struct {
+	name           string
 	FetchServers   []*FetchServer
 	muFetchServers sync.Mutex
 	Transport      filters.RoundTripFilter
 	Sites          *httpproxy.HostMatcher
+	AutoRange      *AutoRange
 }
 
 func init() {
-	filename := filterName + ".json"
-	config := new(Config)
-	err := storage.ReadJsonConfig(filters.LookupConfigStoreURI(filterName), filename, config)
-	if err != nil {
-		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
-	}
-
-	err = filters.Register(filterName, &filters.RegisteredFilter{
-		New: func() (filters.Filter, error) {
-			return NewFilter(config)
+	err := filters.Register(filterName, &filters.RegisteredFilter{
+		New: func(name string) (filters.Filter, error) {
+			config := new(Config)
+			if err := filters.ReadConfig(name, config); err != nil {
+				return nil, err
+			}
+			return NewFilter(name, config)
 		},
 	})
 
@@ -65,8 +67,8 @@ func init() {
 	}
 }
 
-func NewFilter(config *Config) (filters.Filter, error) {
-	f1, err := filters.GetFilter(config.Transport)
+func NewFilter(name string, config *Config) (filters.Filter, error) {
+	f1, err := filters.GetTransport(name, config.Transport)
 	if err != nil {
 		return nil, err
 	}
@@ -83,7 +85,7 @@ func NewFilter(config *Config) (filters.Filter, error) {
 		case 0, 1:
 			rawurl = fmt.Sprintf("%s://%s.%s%s", config.Scheme, appid, config.Domain, config.Path)
 		default:
-			rawurl = fmt.Sprintf("%s://%s.%s%s", config.Scheme, appid, config.Path)
+			rawurl = fmt.Sprintf("%s://%s%s", config.Scheme, appid, config.Path)
 		}
 		u, err := url.Parse(rawurl)
 		if err != nil {
@@ -99,29 +101,154 @@ func NewFilter(config *Config) (filters.Filter, error) {
 		fetchServers = append(fetchServers, fs)
 	}
 
+	autoRange := &AutoRange{
+		Threads: config.AutoRange.Threads,
+		MaxSize: int64(config.AutoRange.MaxSize),
+		BufSize: config.AutoRange.BufSize,
+		Sites:   httpproxy.NewHostMatcher(config.AutoRange.Sites),
+		Suffixs: config.AutoRange.Suffixs,
+	}
+
 	return &Filter{
+		name:         name,
 		FetchServers: fetchServers,
 		Transport:    f2,
 		Sites:        httpproxy.NewHostMatcher(config.Sites),
+		AutoRange:    autoRange,
 	}, nil
 }
 
 func (p *Filter) FilterName() string {
-	return filterName
+	return p.name
+}
+
+func (f *Filter) ServeAdmin(rw http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/appids" {
+		http.NotFound(rw, req)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+	case "POST":
+		// appids listed in the form move to the front in their order
+		appids := strings.Split(req.FormValue("appids"), ",")
+		if err := f.reorder(appids); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		glog.Infof("GAE reorder appids to %v", appids)
+	default:
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	f.muFetchServers.Lock()
+	hosts := make([]string, len(f.FetchServers))
+	for i, fs := range f.FetchServers {
+		hosts[i] = fs.URL.Host
+	}
+	f.muFetchServers.Unlock()
+
+	httpproxy.WriteJSON(rw, http.StatusOK, map[string][]string{"AppIds": hosts})
+}
+
+func (f *Filter) reorder(appids []string) error {
+	f.muFetchServers.Lock()
+	defer f.muFetchServers.Unlock()
+
+	fetchServers := make([]*FetchServer, 0, len(f.FetchServers))
+	used := make(map[*FetchServer]struct{})
+	for _, appid := range appids {
+		appid = strings.TrimSpace(appid)
+		if appid == "" {
+			continue
+		}
+		var found *FetchServer
+		for _, fs := range f.FetchServers {
+			if fs.URL.Host == appid || strings.HasPrefix(fs.URL.Host, appid+".") {
+				found = fs
+				break
+			}
+		}
+		if found == nil {
+			return fmt.Errorf("unknown appid %#v", appid)
+		}
+		if _, ok := used[found]; !ok {
+			used[found] = struct{}{}
+			fetchServers = append(fetchServers, found)
+		}
+	}
+
+	for _, fs := range f.FetchServers {
+		if _, ok := used[fs]; !ok {
+			fetchServers = append(fetchServers, fs)
+		}
+	}
+
+	copy(f.FetchServers, fetchServers)
+	return nil
+}
+
+func (f *Filter) MatchHost(host string) map[string]interface{} {
+	return map[string]interface{}{
+		"Sites":           f.Sites.Match(host),
+		"AutoRange.Sites": f.AutoRange.Sites.Match(host),
+	}
 }
 
 func (f *Filter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Response, error) {
-	ctx, resp, err := f.roundTrip(ctx, req)
+	if ctx.GetRoundTripFilter() != f && !f.Sites.Match(req.Host) {
+		return ctx, nil, nil
+	}
 
-	if err != nil || resp == nil {
+	if !f.AutoRange.Match(req) {
+		return f.roundTrip(ctx, req)
+	}
+
+	rangeStart, rangeEnd, hasRange := parseRange(req.Header.Get("Range"))
+	if !hasRange && req.Header.Get("Range") != "" {
+		return f.roundTrip(ctx, req)
+	}
+
+	end := rangeStart + f.AutoRange.MaxSize - 1
+	if rangeEnd >= 0 && rangeEnd < end {
+		end = rangeEnd
+	}
+	req1 := req.Clone(req.Context())
+	req1.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", rangeStart, end))
+
+	ctx, resp, err := f.roundTrip(ctx, req1)
+	if err != nil || resp == nil || resp.StatusCode != 206 {
 		return ctx, resp, err
 	}
 
-	if resp.StatusCode == 206 {
+	start, end, length, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if !ok || start != rangeStart {
 		return ctx, resp, err
 	}
 
-	return ctx, resp, err
+	last := length - 1
+	if rangeEnd >= 0 && rangeEnd < last {
+		last = rangeEnd
+	}
+
+	if hasRange {
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, last, length))
+	} else {
+		resp.Status = "200 OK"
+		resp.StatusCode = 200
+		resp.Header.Del("Content-Range")
+	}
+	resp.ContentLength = last - start + 1
+	resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+
+	if end < last {
+		glog.V(2).Infof("%s \"GAE AUTORANGE %s %s %s\" %d-%d/%d", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, start, last, length)
+		resp.Body = httpproxy.NewMultiReadCloser(resp.Body, f.autoRange(req, end+1, last))
+	}
+
+	return ctx, resp, nil
 }
 
 func (f *Filter) roundTrip(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Response, error) {
@@ -130,19 +257,28 @@ func (f *Filter) roundTrip(ctx *filters.Context, req *http.Request) (*filters.Co
 		i += rand.Intn(len(f.FetchServers) - i)
 	}
 
-	fetchServer := f.FetchServers[i]
+	return f.fetch(ctx, req, f.fetchServer(i))
+}
+
+// fetchServer returns the i-th FetchServer, wrapping around, the order is
+// changed by appid rotations and the admin api.
+func (f *Filter) fetchServer(i int) *FetchServer {
+	f.muFetchServers.Lock()
+	defer f.muFetchServers.Unlock()
+	return f.FetchServers[i%len(f.FetchServers)]
+}
 
+func (f *Filter) fetch(ctx *filters.Context, req *http.Request, fetchServer *FetchServer) (*filters.Context, *http.Response, error) {
 	req1, err := fetchServer.encodeRequest(req)
 	if err != nil {
 		return ctx, nil, fmt.Errorf("GAE encodeRequest: %s", err.Error())
 	}
 
+	ctx.SetUpstream(fetchServer.URL.Host)
 	ctx, resp, err := f.Transport.RoundTrip(ctx, req1)
 	if err != nil || resp == nil {
 		glog.Errorf("%s \"GAE %s %s %s\" %#v %v", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, resp, err)
 		return ctx, resp, err
-	} else {
-		glog.Infof("%s \"GAE %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
 	}
 
 	switch resp.StatusCode {
@@ -151,6 +287,7 @@ func (f *Filter) roundTrip(ctx *filters.Context, req *http.Request) (*filters.Co
 			break
 		}
 		glog.Warningf("%s over qouta, switch to next appid.", fetchServer.URL.String())
+		appidRotations.Inc()
 		f.muFetchServers.Lock()
 		if fetchServer == f.FetchServers[0] {
 			for i := 0; i < len(f.FetchServers)-1; i++ {
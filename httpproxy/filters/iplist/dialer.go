@@ -1,6 +1,7 @@
 package iplist
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -16,8 +17,11 @@ import (
 	"github.com/miekg/dns"
 
 	"../../../httpproxy"
+	"../../metrics"
 )
 
+var dialRaces = metrics.NewCounter("goproxy_iplist_dial_races_total", "Outcomes of iplist dial races, by protocol and result.", "proto", "result")
+
 type Iplist struct {
 	lists      map[string][]string
 	dnsservers []string
@@ -180,6 +184,16 @@ type Dialer struct {
 }
 
 func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *Dialer) DialTLS(network, address string) (net.Conn, error) {
+	return d.DialTLSContext(context.Background(), network, address)
+}
+
+// DialContext dials address, racing the addresses of its iplist, until ctx
+// is done.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
 	glog.V(2).Infof("Dail(%#v, %#v)...", network, address)
 	switch network {
 	case "tcp", "tcp4", "tcp6":
@@ -191,17 +205,17 @@ func (d *Dialer) Dial(network, address string) (net.Conn, error) {
 					for i, host := range hosts {
 						addrs[i] = net.JoinHostPort(host, port)
 					}
-					return d.dialMulti(network, addrs)
+					return d.dialMulti(ctx, network, addrs)
 				}
 			}
 		}
 	default:
 		break
 	}
-	return d.Dialer.Dial(network, address)
+	return d.Dialer.DialContext(ctx, network, address)
 }
 
-func (d *Dialer) DialTLS(network, address string) (net.Conn, error) {
+func (d *Dialer) DialTLSContext(ctx context.Context, network, address string) (net.Conn, error) {
 	switch network {
 	case "tcp", "tcp4", "tcp6":
 		if host, port, err := net.SplitHostPort(address); err == nil {
@@ -224,17 +238,20 @@ func (d *Dialer) DialTLS(network, address string) (net.Conn, error) {
 					for i, host := range hosts {
 						addrs[i] = net.JoinHostPort(host, port)
 					}
-					return d.dialMultiTLS(network, addrs, config)
+					return d.dialMultiTLS(ctx, network, addrs, config)
 				}
 			}
 		}
 	default:
 		break
 	}
-	return tls.DialWithDialer(&d.Dialer, network, address, d.TLSConfig)
+	td := &tls.Dialer{NetDialer: &d.Dialer, Config: d.TLSConfig}
+	return td.DialContext(ctx, network, address)
 }
 
-func (d *Dialer) dialMulti(network string, addrs []string) (net.Conn, error) {
+// dialMulti races the dials to addrs, the losers are canceled once one of
+// them connected.
+func (d *Dialer) dialMulti(ctx context.Context, network string, addrs []string) (net.Conn, error) {
 	type racer struct {
 		conn net.Conn
 		err  error
@@ -248,14 +265,17 @@ func (d *Dialer) dialMulti(network string, addrs []string) (net.Conn, error) {
 	addrs = pickupAddrs(addrs, length, d.connTCPDuration)
 	lane := make(chan racer, length)
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	for _, addr := range addrs {
 		go func(addr string, c chan<- racer) {
 			start := time.Now()
-			conn, err := d.Dialer.Dial(network, addr)
+			conn, err := d.Dialer.DialContext(ctx, network, addr)
 			end := time.Now()
 			if err == nil {
 				d.connTCPDuration.Set(addr, end.Sub(start), end.Add(d.connExpireDuration))
-			} else {
+			} else if ctx.Err() == nil {
 				d.connTCPDuration.Del(addr)
 			}
 			lane <- racer{conn, err}
@@ -275,13 +295,17 @@ func (d *Dialer) dialMulti(network string, addrs []string) (net.Conn, error) {
 					}
 				}
 			}(length - 1 - i)
+			dialRaces.Inc("tcp", "success")
 			return r.conn, nil
 		}
 	}
+	dialRaces.Inc("tcp", "failure")
 	return nil, r.err
 }
 
-func (d *Dialer) dialMultiTLS(network string, addrs []string, config *tls.Config) (net.Conn, error) {
+// dialMultiTLS races the dials and handshakes to addrs, the losers are
+// canceled once one of them finished the handshake.
+func (d *Dialer) dialMultiTLS(ctx context.Context, network string, addrs []string, config *tls.Config) (net.Conn, error) {
 	type racer struct {
 		conn net.Conn
 		err  error
@@ -295,10 +319,13 @@ func (d *Dialer) dialMultiTLS(network string, addrs []string, config *tls.Config
 	addrs = pickupAddrs(addrs, length, d.connTLSDuration)
 	lane := make(chan racer, length)
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	for _, addr := range addrs {
 		go func(addr string, c chan<- racer) {
 			start := time.Now()
-			conn, err := d.Dialer.Dial(network, addr)
+			conn, err := d.Dialer.DialContext(ctx, network, addr)
 			if err != nil {
 				lane <- racer{conn, err}
 				return
@@ -311,12 +338,12 @@ func (d *Dialer) dialMultiTLS(network string, addrs []string, config *tls.Config
 			}
 
 			tlsConn := tls.Client(conn, config)
-			err = tlsConn.Handshake()
+			err = tlsConn.HandshakeContext(ctx)
 
 			end := time.Now()
 			if err == nil {
 				d.connTLSDuration.Set(addr, end.Sub(start), end.Add(d.connExpireDuration))
-			} else {
+			} else if ctx.Err() == nil {
 				d.connTLSDuration.Del(addr)
 			}
 
@@ -337,9 +364,11 @@ func (d *Dialer) dialMultiTLS(network string, addrs []string, config *tls.Config
 					}
 				}
 			}(length - 1 - i)
+			dialRaces.Inc("tls", "success")
 			return r.conn, nil
 		}
 	}
+	dialRaces.Inc("tls", "failure")
 	return nil, r.err
 }
 
@@ -362,6 +391,36 @@ func (r racers) Less(i, j int) bool {
 	return r[i].duration < r[j].duration
 }
 
+type latency struct {
+	TCP string `json:",omitempty"`
+	TLS string `json:",omitempty"`
+}
+
+// latency returns the known connection latencies to port of each iplist.
+func (d *Dialer) latency(port string) map[string]map[string]latency {
+	tables := make(map[string]map[string]latency)
+	for name := range d.iplist.lists {
+		hosts, err := d.iplist.Lookup(name)
+		if err != nil {
+			continue
+		}
+		table := make(map[string]latency)
+		for _, host := range hosts {
+			addr := net.JoinHostPort(host, port)
+			var l latency
+			if v, ok := d.connTCPDuration.GetQuiet(addr); ok {
+				l.TCP = v.(time.Duration).String()
+			}
+			if v, ok := d.connTLSDuration.GetQuiet(addr); ok {
+				l.TLS = v.(time.Duration).String()
+			}
+			table[host] = l
+		}
+		tables[name] = table
+	}
+	return tables
+}
+
 func pickupAddrs(addrs []string, n int, duration lrucache.Cache) []string {
 	if len(addrs) <= n {
 		return addrs
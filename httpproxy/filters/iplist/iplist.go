@@ -2,19 +2,18 @@ package iplist
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
-	"fmt"
-	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/cloudflare/golibs/lrucache"
 	"github.com/golang/glog"
 
 	"../../../httpproxy"
-	"../../../storage"
 	"../../filters"
 )
 
@@ -35,6 +34,10 @@ type Config struct {
 		TLSHandshakeTimeout int
 		MaxIdleConnsPerHost int
 	}
+	Tunnel struct {
+		IdleTimeout int
+		Timeout     int
+	}
 	Hosts  map[string]string
 	Iplist map[string][]string
 	DNS    struct {
@@ -45,22 +48,24 @@ type Config struct {
 }
 
 type Filter struct {
+	name string
 	filters.RoundTripFilter
 	transport *http.Transport
 	dialer    *Dialer
+	relay     *httpproxy.Relay
+	expand    []string
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
 }
 
 func init() {
-	filename := filterName + ".json"
-	config := new(Config)
-	err := storage.ReadJsonConfig(filters.LookupConfigStoreURI(filterName), filename, config)
-	if err != nil {
-		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
-	}
-
-	err = filters.Register(filterName, &filters.RegisteredFilter{
-		New: func() (filters.Filter, error) {
-			return NewFilter(config)
+	err := filters.Register(filterName, &filters.RegisteredFilter{
+		New: func(name string) (filters.Filter, error) {
+			config := new(Config)
+			if err := filters.ReadConfig(name, config); err != nil {
+				return nil, err
+			}
+			return NewFilter(name, config)
 		},
 	})
 
@@ -69,7 +74,7 @@ func init() {
 	}
 }
 
-func NewFilter(config *Config) (filters.Filter, error) {
+func NewFilter(name string, config *Config) (filters.Filter, error) {
 	d := &Dialer{}
 	d.Timeout = time.Duration(config.Dialer.Timeout) * time.Second
 	d.KeepAlive = time.Duration(config.Dialer.KeepAlive) * time.Second
@@ -106,78 +111,156 @@ func NewFilter(config *Config) (filters.Filter, error) {
 	d.connTLSDuration = lrucache.NewMultiLRUCache(4, 4096)
 	d.connExpireDuration = 5 * time.Minute
 
+	expand := make([]string, 0)
 	for _, name := range config.DNS.Expand {
 		if _, ok := config.Iplist[name]; ok {
-			go func(name string) {
-				t := time.Tick(3 * time.Minute)
-				for {
-					select {
-					case <-t:
-						d.iplist.ExpandList(name)
-					}
-				}
-			}(name)
+			expand = append(expand, name)
 		}
 	}
 
 	return &Filter{
+		name: name,
 		transport: &http.Transport{
-			Dial:                d.Dial,
-			DialTLS:             d.DialTLS,
+			DialContext:         d.DialContext,
+			DialTLSContext:      d.DialTLSContext,
 			DisableKeepAlives:   config.Transport.DisableKeepAlives,
 			DisableCompression:  config.Transport.DisableCompression,
 			TLSHandshakeTimeout: time.Duration(config.Transport.TLSHandshakeTimeout) * time.Second,
 			MaxIdleConnsPerHost: config.Transport.MaxIdleConnsPerHost,
 		},
 		dialer: d,
+		relay: &httpproxy.Relay{
+			IdleTimeout: time.Duration(config.Tunnel.IdleTimeout) * time.Second,
+			Timeout:     time.Duration(config.Tunnel.Timeout) * time.Second,
+		},
+		expand: expand,
 	}, nil
 }
 
+// Start expands the DNS.Expand lists every 3 minutes until ctx is done or f
+// is closed.
+func (f *Filter) Start(ctx context.Context) error {
+	ctx, f.cancel = context.WithCancel(ctx)
+	for _, name := range f.expand {
+		f.wg.Add(1)
+		go func(name string) {
+			defer f.wg.Done()
+			ticker := time.NewTicker(3 * time.Minute)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					f.dialer.iplist.ExpandList(name)
+				}
+			}
+		}(name)
+	}
+	return nil
+}
+
+func (f *Filter) Close(ctx context.Context) error {
+	f.transport.CloseIdleConnections()
+
+	if f.cancel == nil {
+		return nil
+	}
+	f.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (f *Filter) FilterName() string {
-	return filterName
+	return f.name
+}
+
+func (f *Filter) ServeAdmin(rw http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.URL.Path == "/latency" && req.Method == "GET":
+		port := req.URL.Query().Get("port")
+		if port == "" {
+			port = "443"
+		}
+		httpproxy.WriteJSON(rw, http.StatusOK, f.dialer.latency(port))
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func (f *Filter) MatchHost(host string) map[string]interface{} {
+	value, _ := f.dialer.hosts.Lookup(host)
+	return map[string]interface{}{"Hosts": value}
 }
 
 func (f *Filter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Response, error) {
-	if _, ok := f.dialer.hosts.Lookup(req.Host); !ok {
+	if _, ok := f.dialer.hosts.Lookup(req.Host); !ok && ctx.GetRoundTripFilter() != f {
 		return ctx, nil, nil
 	}
 
 	switch req.Method {
 	case "CONNECT":
-		glog.Infof("%s \"IPLIST %s %s %s\" - -", req.RemoteAddr, req.Method, req.Host, req.Proto)
-		remote, err := f.transport.Dial("tcp", req.Host)
+		remote, err := f.dialer.DialContext(ctx.Context(), "tcp", req.Host)
 		if err != nil {
 			return ctx, nil, err
 		}
+		ctx.SetUpstream(remote.RemoteAddr().String())
+		ctx.AddCloser(remote)
 
-		switch req.Proto {
-		case "HTTP/2.0":
-			rw := ctx.GetResponseWriter()
-			io.WriteString(rw, "HTTP/1.1 200 OK\r\n\r\n")
-			go httpproxy.IoCopy(remote, req.Body)
-			httpproxy.IoCopy(rw, remote)
-		case "HTTP/1.1", "HTTP/1.0":
-			rw := ctx.GetResponseWriter()
-			hijacker, ok := rw.(http.Hijacker)
-			if !ok {
-				return ctx, nil, fmt.Errorf("http.ResponseWriter(%#v) does not implments Hijacker", rw)
-			}
-			local, _, err := hijacker.Hijack()
-			if err != nil {
-				return ctx, nil, err
-			}
-			local.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
-			go httpproxy.IoCopy(remote, local)
-			httpproxy.IoCopy(local, remote)
-		default:
-			glog.Warningf("Unkown req=%#v", req)
+		defer remote.Close()
+
+		local, err := httpproxy.HijackConnect(ctx.GetResponseWriter(), req)
+		if err != nil {
+			return ctx, nil, err
 		}
+		defer local.Close()
+
+		f.relay.Copy(local, remote)
+
 		ctx.SetHijacked(true)
 		return ctx, nil, nil
 	case "PRI":
-		//TODO: fix for http2
-		return ctx, nil, nil
+		// A h2c preface is meant for the proxy itself, ask the client to use HTTP/1.1 or TLS
+		data := "HTTP/2 with prior knowledge is not supported"
+		resp := &http.Response{
+			Status:        "505 HTTP Version Not Supported",
+			StatusCode:    http.StatusHTTPVersionNotSupported,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{},
+			Request:       req,
+			Close:         true,
+			ContentLength: int64(len(data)),
+			Body:          ioutil.NopCloser(bytes.NewReader([]byte(data))),
+		}
+		return ctx, resp, nil
 	default:
+		if httpproxy.IsUpgrade(req) {
+			rconn, err := f.dialUpgrade(req)
+			if err != nil {
+				return ctx, nil, err
+			}
+			ctx.SetUpstream(rconn.RemoteAddr().String())
+			ctx.AddCloser(rconn)
+			resp, err := httpproxy.Upgrade(ctx.GetResponseWriter(), req, rconn, f.relay)
+			if err == nil && resp == nil {
+				ctx.SetHijacked(true)
+			}
+			return ctx, resp, err
+		}
+
+		ctx.SetUpstream(req.URL.Host)
 		resp, err := f.transport.RoundTrip(req)
 		if err != nil {
 			glog.Errorf("%s \"IPLIST %s %s %s\" error: %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, err)
@@ -195,11 +278,14 @@ func (f *Filter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Co
 				Body:          ioutil.NopCloser(bytes.NewReader([]byte(data))),
 			}
 			err = nil
-		} else {
-			if req.RemoteAddr != "" {
-				glog.Infof("%s \"IPLIST %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
-			}
 		}
 		return ctx, resp, err
 	}
 }
+
+func (f *Filter) dialUpgrade(req *http.Request) (net.Conn, error) {
+	if req.URL.Scheme == "https" {
+		return f.dialer.DialTLSContext(req.Context(), "tcp", httpproxy.UpgradeAddr(req))
+	}
+	return f.dialer.DialContext(req.Context(), "tcp", httpproxy.UpgradeAddr(req))
+}
@@ -0,0 +1,398 @@
+package peercache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+	"github.com/golang/glog"
+	"github.com/golang/groupcache"
+
+	"../../../httpproxy"
+	"../../filters"
+)
+
+const (
+	filterName string = "peercache"
+
+	defaultGroup         string = "peercache"
+	defaultMaxObjectSize int64  = 8 * 1024 * 1024
+)
+
+type Config struct {
+	Group         string
+	CacheBytes    int64
+	Expires       int
+	MaxObjectSize int64
+	KeyHeaders    []string
+	Sites         []string
+	Suffixs       []string
+	Transport     string
+}
+
+type Filter struct {
+	name          string
+	Group         *groupcache.Group
+	Expires       time.Duration
+	MaxObjectSize int64
+	KeyHeaders    []string
+	Sites         *httpproxy.HostMatcher
+	Suffixs       []string
+	Transport     filters.RoundTripFilter
+	// uncacheable keeps the keys failed to fill, they are fetched by the
+	// next filters without asking the peers again
+	uncacheable lrucache.Cache
+}
+
+// fillResult passes the response of a local fill back to the request, when
+// it can not be put into groupcache.
+type fillResult struct {
+	resp *http.Response
+}
+
+type fillResultKey struct{}
+
+var (
+	// groups keeps the latest filter of each group, groupcache groups can not
+	// be re-created so their getters look it up here after reloading.
+	groups   = make(map[string]*Filter)
+	muGroups sync.Mutex
+)
+
+func init() {
+	err := filters.Register(filterName, &filters.RegisteredFilter{
+		New: func(name string) (filters.Filter, error) {
+			config := new(Config)
+			if err := filters.ReadConfig(name, config); err != nil {
+				return nil, err
+			}
+			return NewFilter(name, config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(name string, config *Config) (filters.Filter, error) {
+	f1, err := filters.GetTransport(name, config.Transport)
+	if err != nil {
+		return nil, err
+	}
+
+	f2, ok := f1.(filters.RoundTripFilter)
+	if !ok {
+		return nil, fmt.Errorf("%#v was not a filters.RoundTripFilter", f1)
+	}
+
+	f := &Filter{
+		name:          name,
+		Expires:       time.Duration(config.Expires) * time.Second,
+		MaxObjectSize: config.MaxObjectSize,
+		KeyHeaders:    make([]string, 0),
+		Sites:         httpproxy.NewHostMatcher(config.Sites),
+		Suffixs:       config.Suffixs,
+		Transport:     f2,
+		uncacheable:   lrucache.NewLRUCache(4096),
+	}
+
+	if f.Expires <= 0 {
+		return nil, fmt.Errorf("peercache Expires must be positive, got %d", config.Expires)
+	}
+
+	if f.MaxObjectSize <= 0 {
+		f.MaxObjectSize = defaultMaxObjectSize
+	}
+
+	for _, key := range config.KeyHeaders {
+		f.KeyHeaders = append(f.KeyHeaders, http.CanonicalHeaderKey(key))
+	}
+
+	group := config.Group
+	if group == "" {
+		group = defaultGroup
+	}
+
+	muGroups.Lock()
+	defer muGroups.Unlock()
+
+	groups[group] = f
+	// CacheBytes only takes effect for the first filter of a group
+	if f.Group = groupcache.GetGroup(group); f.Group == nil {
+		f.Group = groupcache.NewGroup(group, config.CacheBytes, groupcache.GetterFunc(func(ctx context.Context, key string, dest groupcache.Sink) error {
+			muGroups.Lock()
+			f := groups[group]
+			muGroups.Unlock()
+			return f.fill(ctx, key, dest)
+		}))
+	}
+
+	return f, nil
+}
+
+func (f *Filter) FilterName() string {
+	return f.name
+}
+
+func (f *Filter) MatchHost(host string) map[string]interface{} {
+	return map[string]interface{}{"Sites": f.Sites.Match(host)}
+}
+
+func (f *Filter) Match(req *http.Request) bool {
+	if req.Method != "GET" || req.Header.Get("Range") != "" || req.Header.Get("Authorization") != "" {
+		return false
+	}
+
+	if !f.Sites.Match(req.Host) {
+		return false
+	}
+
+	// local networks are not shared with peers
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil && (ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()) {
+		return false
+	}
+
+	if len(f.Suffixs) == 0 {
+		return true
+	}
+
+	name := path.Base(req.URL.Path)
+	for _, pattern := range f.Suffixs {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *Filter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Response, error) {
+	if !f.Match(req) {
+		if ctx.GetRoundTripFilter() == f {
+			return f.Transport.RoundTrip(ctx, req)
+		}
+		return ctx, nil, nil
+	}
+
+	key := f.key(req)
+	if _, ok := f.uncacheable.Get(key); ok {
+		return f.next(ctx, req)
+	}
+
+	var data []byte
+	result := &fillResult{}
+	if err := f.Group.Get(context.WithValue(req.Context(), fillResultKey{}, result), key, groupcache.AllocatingByteSliceSink(&data)); err != nil {
+		glog.V(2).Infof("%s \"PEERCACHE %s %s %s\" error: %v", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, err)
+		f.uncacheable.Set(key, struct{}{}, time.Now().Add(f.Expires))
+		if result.resp != nil {
+			result.resp.Request = req
+			return ctx, result.resp, nil
+		}
+		return f.next(ctx, req)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), req)
+	if err != nil {
+		return ctx, nil, err
+	}
+
+	return ctx, resp, nil
+}
+
+// next passes req to the next filters, or to Transport if the router
+// dispatched req to f.
+func (f *Filter) next(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Response, error) {
+	if ctx.GetRoundTripFilter() == f {
+		return f.Transport.RoundTrip(ctx, req)
+	}
+	return ctx, nil, nil
+}
+
+// key encodes the expiry period, url and key headers of req, entries of the
+// previous period are not hit any more and evicted by groupcache.
+func (f *Filter) key(req *http.Request) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%d\n%s\n", time.Now().UnixNano()/int64(f.Expires), req.URL.String())
+	for _, key := range f.KeyHeaders {
+		if value := req.Header.Get(key); value != "" {
+			fmt.Fprintf(&b, "%s: %s\n", key, value)
+		}
+	}
+	return b.String()
+}
+
+// fill fetches the request encoded in key by Transport, only long-lived
+// responses are put into groupcache. Others are handed to the request in ctx
+// if it is local.
+func (f *Filter) fill(ctx context.Context, key string, dest groupcache.Sink) error {
+	req, err := f.parseKey(key)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := filters.RoundTrip(f.Transport, req)
+	if err != nil {
+		return err
+	}
+
+	if err := f.cacheable(resp); err != nil {
+		if result, ok := ctx.Value(fillResultKey{}).(*fillResult); ok {
+			result.resp = resp
+		} else {
+			resp.Body.Close()
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, f.MaxObjectSize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > f.MaxObjectSize {
+		return fmt.Errorf("%s is larger than %d bytes", req.URL.String(), f.MaxObjectSize)
+	}
+
+	header := http.Header{}
+	for key, values := range resp.Header {
+		switch key {
+		case "Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Trailer", "Upgrade", "Content-Length":
+			continue
+		}
+		header[key] = values
+	}
+
+	resp1 := &http.Response{
+		Status:        resp.Status,
+		StatusCode:    resp.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+	}
+
+	var b bytes.Buffer
+	if err := resp1.Write(&b); err != nil {
+		return err
+	}
+
+	return dest.SetBytes(b.Bytes())
+}
+
+// parseKey decodes the request of key, which may come from a peer, so it must
+// be of the current period and pass Match.
+func (f *Filter) parseKey(key string) (*http.Request, error) {
+	lines := strings.Split(strings.TrimSuffix(key, "\n"), "\n")
+	if len(lines) < 2 {
+		return nil, fmt.Errorf("invalid peercache key %#v", key)
+	}
+
+	period := time.Now().UnixNano() / int64(f.Expires)
+	if n, err := strconv.ParseInt(lines[0], 10, 64); err != nil || n < period-1 || n > period {
+		return nil, fmt.Errorf("peercache key %#v is expired", key)
+	}
+
+	u, err := url.Parse(lines[1])
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.User != nil {
+		return nil, fmt.Errorf("peercache key url %#v is not allowed", lines[1])
+	}
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines[2:] {
+		parts := strings.SplitN(line, ": ", 2)
+		if len(parts) != 2 || !contains(f.KeyHeaders, parts[0]) {
+			return nil, fmt.Errorf("peercache key header %#v is not allowed", line)
+		}
+		req.Header.Set(parts[0], parts[1])
+	}
+
+	if !f.Match(req) {
+		return nil, fmt.Errorf("peercache key %#v does not match", key)
+	}
+
+	return req, nil
+}
+
+// cacheable checks resp is shareable and fresh for at least Expires.
+func (f *Filter) cacheable(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s is not cacheable", resp.Status)
+	}
+
+	if resp.Header.Get("Set-Cookie") != "" {
+		return fmt.Errorf("response with Set-Cookie is not cacheable")
+	}
+
+	for _, value := range resp.Header["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" && !contains(f.KeyHeaders, name) {
+				return fmt.Errorf("response varies on %#v which is not a key header", name)
+			}
+		}
+	}
+
+	var lifetime time.Duration
+	for _, value := range resp.Header["Cache-Control"] {
+		for _, part := range strings.Split(value, ",") {
+			part = strings.ToLower(strings.TrimSpace(part))
+			switch {
+			case part == "no-store", part == "no-cache", part == "private":
+				return fmt.Errorf("Cache-Control %#v is not cacheable", value)
+			case part == "immutable":
+				lifetime = f.Expires
+			case strings.HasPrefix(part, "max-age="), strings.HasPrefix(part, "s-maxage="):
+				if n, err := strconv.ParseInt(part[strings.Index(part, "=")+1:], 10, 64); err == nil && time.Duration(n)*time.Second > lifetime {
+					lifetime = time.Duration(n) * time.Second
+				}
+			}
+		}
+	}
+
+	if lifetime == 0 {
+		if expires, err := http.ParseTime(resp.Header.Get("Expires")); err == nil {
+			lifetime = time.Until(expires)
+		}
+	}
+
+	if lifetime < f.Expires {
+		return fmt.Errorf("response lifetime %s is shorter than %s", lifetime, f.Expires)
+	}
+
+	return nil
+}
+
+func contains(names []string, name string) bool {
+	for _, s := range names {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
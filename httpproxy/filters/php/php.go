@@ -13,7 +13,6 @@ import (
 	"github.com/golang/glog"
 
 	"../../../httpproxy"
-	"../../../storage"
 	"../../filters"
 	"../../transport/direct"
 	"../../transport/php"
@@ -48,21 +47,19 @@ type Config struct {
 }
 
 type Filter struct {
+	name       string
 	Transports []php.Transport
 	Sites      *httpproxy.HostMatcher
 }
 
 func init() {
-	filename := filterName + ".json"
-	config := new(Config)
-	err := storage.ReadJsonConfig(filters.LookupConfigStoreURI(filterName), filename, config)
-	if err != nil {
-		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
-	}
-
-	err = filters.Register(filterName, &filters.RegisteredFilter{
-		New: func() (filters.Filter, error) {
-			return NewFilter(config)
+	err := filters.Register(filterName, &filters.RegisteredFilter{
+		New: func(name string) (filters.Filter, error) {
+			config := new(Config)
+			if err := filters.ReadConfig(name, config); err != nil {
+				return nil, err
+			}
+			return NewFilter(name, config)
 		},
 	})
 
@@ -71,7 +68,7 @@ func init() {
 	}
 }
 
-func NewFilter(config *Config) (filters.Filter, error) {
+func NewFilter(name string, config *Config) (filters.Filter, error) {
 	d := &direct.Dialer{
 		Dialer: net.Dialer{
 			KeepAlive: time.Duration(config.Transport.Dialer.KeepAlive) * time.Second,
@@ -86,7 +83,7 @@ func NewFilter(config *Config) (filters.Filter, error) {
 	}
 
 	tr := &http.Transport{
-		Dial: d.Dial,
+		DialContext: d.DialContext,
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: false,
 			ClientSessionCache: tls.NewLRUClientSessionCache(1000),
@@ -115,17 +112,18 @@ func NewFilter(config *Config) (filters.Filter, error) {
 	}
 
 	return &Filter{
+		name:       name,
 		Transports: transports,
 		Sites:      httpproxy.NewHostMatcher(config.Sites),
 	}, nil
 }
 
 func (p *Filter) FilterName() string {
-	return filterName
+	return p.name
 }
 
 func (f *Filter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Response, error) {
-	if !f.Sites.Match(req.Host) {
+	if ctx.GetRoundTripFilter() != f && !f.Sites.Match(req.Host) {
 		return ctx, nil, nil
 	}
 
@@ -156,12 +154,11 @@ func (f *Filter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Co
 	}
 
 	tr := f.Transports[i]
+	ctx.SetUpstream(tr.Server.URL.Host)
 
 	resp, err := tr.RoundTrip(req)
 	if err != nil {
 		return ctx, nil, err
-	} else {
-		glog.Infof("%s \"PHP %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
 	}
 	return ctx, resp, nil
 }
@@ -7,7 +7,6 @@ import (
 	"github.com/golang/glog"
 	"github.com/juju/ratelimit"
 
-	"../../../storage"
 	"../../filters"
 )
 
@@ -22,22 +21,20 @@ type Config struct {
 }
 
 type Filter struct {
+	name      string
 	Threshold int64
 	Rate      float64
 	Capacity  int64
 }
 
 func init() {
-	filename := filterName + ".json"
-	config := new(Config)
-	err := storage.ReadJsonConfig(filters.LookupConfigStoreURI(filterName), filename, config)
-	if err != nil {
-		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
-	}
-
-	err = filters.Register(filterName, &filters.RegisteredFilter{
-		New: func() (filters.Filter, error) {
-			return NewFilter(config)
+	err := filters.Register(filterName, &filters.RegisteredFilter{
+		New: func(name string) (filters.Filter, error) {
+			config := new(Config)
+			if err := filters.ReadConfig(name, config); err != nil {
+				return nil, err
+			}
+			return NewFilter(name, config)
 		},
 	})
 
@@ -46,8 +43,9 @@ func init() {
 	}
 }
 
-func NewFilter(config *Config) (filters.Filter, error) {
+func NewFilter(name string, config *Config) (filters.Filter, error) {
 	f := &Filter{
+		name:      name,
 		Threshold: int64(config.Threshold),
 		Capacity:  int64(config.Capacity),
 		Rate:      float64(config.Rate),
@@ -61,7 +59,7 @@ func NewFilter(config *Config) (filters.Filter, error) {
 }
 
 func (f *Filter) FilterName() string {
-	return filterName
+	return f.name
 }
 
 func (f *Filter) Response(ctx *filters.Context, resp *http.Response) (*filters.Context, *http.Response, error) {
@@ -2,20 +2,18 @@ package stripssl
 
 import (
 	"crypto/tls"
-	"fmt"
-	"io"
 	"net"
 	"net/http"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cloudflare/golibs/lrucache"
 	"github.com/golang/glog"
 
 	"../../../httpproxy"
-	"../../../storage"
 	"../../filters"
 )
 
@@ -35,6 +33,7 @@ type Config struct {
 }
 
 type Filter struct {
+	name           string
 	CA             *RootCA
 	CAExpires      time.Duration
 	TLSConfigCache lrucache.Cache
@@ -43,16 +42,13 @@ type Filter struct {
 }
 
 func init() {
-	filename := filterName + ".json"
-	config := new(Config)
-	err := storage.ReadJsonConfig(filters.LookupConfigStoreURI(filterName), filename, config)
-	if err != nil {
-		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
-	}
-
-	err = filters.Register(filterName, &filters.RegisteredFilter{
-		New: func() (filters.Filter, error) {
-			return NewFilter(config)
+	err := filters.Register(filterName, &filters.RegisteredFilter{
+		New: func(name string) (filters.Filter, error) {
+			config := new(Config)
+			if err := filters.ReadConfig(name, config); err != nil {
+				return nil, err
+			}
+			return NewFilter(name, config)
 		},
 	})
 
@@ -61,7 +57,7 @@ func init() {
 	}
 }
 
-func NewFilter(config *Config) (_ filters.Filter, err error) {
+func NewFilter(name string, config *Config) (_ filters.Filter, err error) {
 	var ca *RootCA
 
 	ca, err = NewRootCA(config.RootCA.Name, time.Duration(config.RootCA.Duration)*time.Second, config.RootCA.RsaBits, config.RootCA.Dirname)
@@ -76,6 +72,7 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 	}
 
 	f := &Filter{
+		name:           name,
 		CA:             ca,
 		CAExpires:      time.Duration(config.RootCA.Duration) * time.Second,
 		TLSConfigCache: lrucache.NewMultiLRUCache(4, 4096),
@@ -95,7 +92,20 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 }
 
 func (f *Filter) FilterName() string {
-	return filterName
+	return f.name
+}
+
+func (f *Filter) ServeAdmin(rw http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.URL.Path == "/flush" && req.Method == "POST":
+		httpproxy.WriteJSON(rw, http.StatusOK, map[string]int{"Flushed": f.TLSConfigCache.Clear()})
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func (f *Filter) MatchHost(host string) map[string]interface{} {
+	return map[string]interface{}{"Sites": f.Match(host)}
 }
 
 func (f *Filter) Match(host string) bool {
@@ -121,23 +131,14 @@ func (f *Filter) Request(ctx *filters.Context, req *http.Request) (*filters.Cont
 		return ctx, req, nil
 	}
 
-	hijacker, ok := ctx.GetResponseWriter().(http.Hijacker)
-	if !ok {
-		return ctx, nil, fmt.Errorf("%#v does not implments Hijacker", ctx.GetResponseWriter())
-	}
-
-	conn, _, err := hijacker.Hijack()
-	if err != nil {
-		return ctx, nil, fmt.Errorf("http.ResponseWriter Hijack failed: %s", err)
-	}
-
-	_, err = io.WriteString(conn, "HTTP/1.1 200 OK\r\n\r\n")
+	conn, err := httpproxy.HijackConnect(ctx.GetResponseWriter(), req)
 	if err != nil {
-		conn.Close()
 		return ctx, nil, err
 	}
-
-	glog.Infof("%s \"STRIP %s %s %s\" - -", req.RemoteAddr, req.Method, req.Host, req.Proto)
+	ctx.AddCloser(conn)
+	if _, ok := conn.(*httpproxy.StreamConn); !ok {
+		conn = &notifyConn{Conn: conn, done: make(chan struct{})}
+	}
 
 	config, err := f.issue(req.Host)
 	if err != nil {
@@ -154,23 +155,53 @@ func (f *Filter) Request(ctx *filters.Context, req *http.Request) (*filters.Cont
 	}
 
 	if ln1, ok := ctx.GetListener().(httpproxy.Listener); ok {
-		ln1.Add(tlsConn)
-		ctx.SetHijacked(true)
-		return ctx, nil, nil
+		if err := ln1.Add(tlsConn); err == nil {
+			ctx.SetHijacked(true)
+			waitClosed(conn)
+			return ctx, nil, nil
+		}
 	}
 
 	loConn, err := net.Dial("tcp", ctx.GetListener().Addr().String())
 	if err != nil {
+		tlsConn.Close()
 		return ctx, nil, err
 	}
 
-	go httpproxy.IoCopy(loConn, tlsConn)
-	go httpproxy.IoCopy(tlsConn, loConn)
+	new(httpproxy.Relay).Copy(tlsConn, loConn)
+	tlsConn.Close()
+	loConn.Close()
 
 	ctx.SetHijacked(true)
 	return ctx, nil, nil
 }
 
+// waitClosed blocks until the stripped connection is closed by its server, so
+// that the tunnel stays in the ConnTable of the handler until then.
+func waitClosed(conn net.Conn) {
+	switch c := conn.(type) {
+	case *httpproxy.StreamConn:
+		<-c.Done()
+	case *notifyConn:
+		<-c.done
+	}
+}
+
+// notifyConn closes done when it is closed.
+type notifyConn struct {
+	net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func (c *notifyConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		close(c.done)
+	})
+	return err
+}
+
 func (f *Filter) issue(host string) (_ *tls.Config, err error) {
 	if h, _, err := net.SplitHostPort(host); err == nil {
 		host = h
@@ -0,0 +1,239 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"../../../httpproxy"
+)
+
+// Dialer dials addresses through a parent http, https or socks5 proxy, socks5
+// proxies get addresses resolved locally, socks5h ones resolve hostnames.
+type Dialer struct {
+	net.Dialer
+	URL       *url.URL
+	TLSConfig *tls.Config
+}
+
+// DialProxy dials the parent proxy itself, with TLS for https proxies.
+func (d *Dialer) DialProxy(network, addr string) (net.Conn, error) {
+	return d.DialProxyContext(context.Background(), network, addr)
+}
+
+func (d *Dialer) DialProxyContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, d.URL.Host)
+	if err != nil || d.URL.Scheme != "https" {
+		return conn, err
+	}
+
+	tlsConn := tls.Client(conn, d.TLSConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Dial opens a tunnel to addr through the parent proxy.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is Dial which gives up once ctx is done, the handshake with
+// the parent proxy included.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.DialProxyContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	defer conn.SetDeadline(time.Time{})
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	switch d.URL.Scheme {
+	case "socks5":
+		if addr, err = d.resolve(ctx, addr); err == nil {
+			err = d.socksConnect(conn, addr)
+		}
+	case "socks5h":
+		err = d.socksConnect(conn, addr)
+	default:
+		conn, err = d.httpConnect(conn, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (d *Dialer) httpConnect(conn net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Opaque: addr},
+		Host:       addr,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+	}
+	if u := d.URL.User; u != nil {
+		password, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+password)))
+	}
+
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("upstream %s CONNECT %s return %s", d.URL.Host, addr, resp.Status)
+	}
+
+	if n := br.Buffered(); n > 0 {
+		data, _ := br.Peek(n)
+		return httpproxy.NewPrefixConn(conn, data), nil
+	}
+	return conn, nil
+}
+
+// resolve replaces the hostname of addr with its first IP address.
+func (d *Dialer) resolve(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return addr, err
+	}
+
+	resolver := d.Dialer.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ips[0].IP.String(), port), nil
+}
+
+func (d *Dialer) socksConnect(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+
+	methods := []byte{0x00}
+	if d.URL.User != nil {
+		methods = []byte{0x00, 0x02}
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	var b [262]byte
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return err
+	}
+	if b[0] != 0x05 {
+		return fmt.Errorf("upstream %s unsupported socks version %d", d.URL.Host, b[0])
+	}
+
+	switch b[1] {
+	case 0x00:
+	case 0x02:
+		if d.URL.User == nil {
+			return fmt.Errorf("upstream %s requires socks password auth", d.URL.Host)
+		}
+		username := d.URL.User.Username()
+		password, _ := d.URL.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return fmt.Errorf("upstream %s socks credential too long", d.URL.Host)
+		}
+		req := []byte{0x01, byte(len(username))}
+		req = append(req, username...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, b[:2]); err != nil {
+			return err
+		}
+		if b[1] != 0x00 {
+			return fmt.Errorf("upstream %s socks auth failed", d.URL.Host)
+		}
+	default:
+		return fmt.Errorf("upstream %s no acceptable socks auth methods", d.URL.Host)
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("upstream socks host %#v too long", host)
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 0x01)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 0x04)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(conn, b[:4]); err != nil {
+		return err
+	}
+	if b[1] != 0x00 {
+		return fmt.Errorf("upstream %s socks CONNECT %s failed with reply %d", d.URL.Host, addr, b[1])
+	}
+
+	n := 0
+	switch b[3] {
+	case 0x01:
+		n = net.IPv4len
+	case 0x04:
+		n = net.IPv6len
+	case 0x03:
+		if _, err := io.ReadFull(conn, b[:1]); err != nil {
+			return err
+		}
+		n = int(b[0])
+	default:
+		return fmt.Errorf("upstream %s unsupported socks address type %d", d.URL.Host, b[3])
+	}
+	if _, err := io.ReadFull(conn, b[:n+2]); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/golang/glog"
+
+	"../../../httpproxy"
+	"../../filters"
+)
+
+const (
+	filterName string = "upstream"
+)
+
+type Config struct {
+	Proxy struct {
+		URL       string
+		Username  string
+		Password  string
+		SSLVerify bool
+	}
+	Dialer struct {
+		Timeout   int
+		KeepAlive int
+	}
+	Transport struct {
+		DisableKeepAlives   bool
+		DisableCompression  bool
+		TLSHandshakeTimeout int
+		MaxIdleConnsPerHost int
+	}
+	Tunnel struct {
+		IdleTimeout int
+		Timeout     int
+	}
+}
+
+type Filter struct {
+	name string
+	filters.RoundTripFilter
+	transport *http.Transport
+	dialer    *Dialer
+	relay     *httpproxy.Relay
+}
+
+func init() {
+	err := filters.Register(filterName, &filters.RegisteredFilter{
+		New: func(name string) (filters.Filter, error) {
+			config := new(Config)
+			if err := filters.ReadConfig(name, config); err != nil {
+				return nil, err
+			}
+			return NewFilter(name, config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(name string, config *Config) (filters.Filter, error) {
+	u, err := url.Parse(config.Proxy.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		switch u.Scheme {
+		case "http":
+			u.Host = net.JoinHostPort(u.Host, "80")
+		case "https":
+			u.Host = net.JoinHostPort(u.Host, "443")
+		case "socks5", "socks5h":
+			u.Host = net.JoinHostPort(u.Host, "1080")
+		default:
+			return nil, fmt.Errorf("unsupported upstream proxy %#v", config.Proxy.URL)
+		}
+	}
+
+	if config.Proxy.Username != "" {
+		u.User = url.UserPassword(config.Proxy.Username, config.Proxy.Password)
+	}
+
+	d := &Dialer{
+		Dialer: net.Dialer{
+			Timeout:   time.Duration(config.Dialer.Timeout) * time.Second,
+			KeepAlive: time.Duration(config.Dialer.KeepAlive) * time.Second,
+		},
+		URL: u,
+		TLSConfig: &tls.Config{
+			ServerName:         u.Hostname(),
+			InsecureSkipVerify: !config.Proxy.SSLVerify,
+			ClientSessionCache: tls.NewLRUClientSessionCache(1000),
+		},
+	}
+
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			ClientSessionCache: tls.NewLRUClientSessionCache(1000),
+		},
+		DisableKeepAlives:   config.Transport.DisableKeepAlives,
+		DisableCompression:  config.Transport.DisableCompression,
+		TLSHandshakeTimeout: time.Duration(config.Transport.TLSHandshakeTimeout) * time.Second,
+		MaxIdleConnsPerHost: config.Transport.MaxIdleConnsPerHost,
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		tr.DialContext = d.DialContext
+	default:
+		// the TLS of a https proxy is done by DialProxy, so the transport sees a http proxy
+		tr.Proxy = http.ProxyURL(&url.URL{Scheme: "http", User: u.User, Host: u.Host})
+		tr.DialContext = d.DialProxyContext
+	}
+
+	return &Filter{
+		name:      name,
+		transport: tr,
+		dialer:    d,
+		relay: &httpproxy.Relay{
+			IdleTimeout: time.Duration(config.Tunnel.IdleTimeout) * time.Second,
+			Timeout:     time.Duration(config.Tunnel.Timeout) * time.Second,
+		},
+	}, nil
+}
+
+func (f *Filter) FilterName() string {
+	return f.name
+}
+
+func (f *Filter) Close(ctx context.Context) error {
+	f.transport.CloseIdleConnections()
+	return nil
+}
+
+func (f *Filter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Response, error) {
+	switch req.Method {
+	case "CONNECT":
+		rconn, err := f.dialer.DialContext(ctx.Context(), "tcp", req.Host)
+		if err != nil {
+			return ctx, nil, err
+		}
+		ctx.SetUpstream(rconn.RemoteAddr().String())
+		ctx.AddCloser(rconn)
+		defer rconn.Close()
+
+		lconn, err := httpproxy.HijackConnect(ctx.GetResponseWriter(), req)
+		if err != nil {
+			return ctx, nil, err
+		}
+		defer lconn.Close()
+
+		f.relay.Copy(lconn, rconn)
+
+		ctx.SetHijacked(true)
+		return ctx, nil, nil
+	default:
+		if httpproxy.IsUpgrade(req) {
+			rconn, err := httpproxy.DialUpgrade(req, f.dialer.DialContext, &tls.Config{ClientSessionCache: f.transport.TLSClientConfig.ClientSessionCache})
+			if err != nil {
+				return ctx, nil, err
+			}
+			ctx.SetUpstream(rconn.RemoteAddr().String())
+			ctx.AddCloser(rconn)
+			resp, err := httpproxy.Upgrade(ctx.GetResponseWriter(), req, rconn, f.relay)
+			if err == nil && resp == nil {
+				ctx.SetHijacked(true)
+			}
+			return ctx, resp, err
+		}
+
+		// the credential of the client is not meant for the parent proxy
+		req.Header.Del("Proxy-Authorization")
+
+		ctx.SetUpstream(f.dialer.URL.Host)
+		resp, err := f.transport.RoundTrip(req)
+		if err != nil {
+			glog.Errorf("%s \"UPSTREAM %s %s %s\" error: %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, err)
+			data := err.Error()
+			resp = &http.Response{
+				Status:        "502 Bad Gateway",
+				StatusCode:    502,
+				Proto:         "HTTP/1.1",
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				Header:        http.Header{},
+				Request:       req,
+				Close:         true,
+				ContentLength: int64(len(data)),
+				Body:          ioutil.NopCloser(bytes.NewReader([]byte(data))),
+			}
+			err = nil
+		}
+		return ctx, resp, err
+	}
+}
@@ -12,7 +12,6 @@ import (
 	"github.com/phuslu/http2"
 
 	"../../../httpproxy"
-	"../../../storage"
 	"../../filters"
 )
 
@@ -31,21 +30,19 @@ type Config struct {
 }
 
 type Filter struct {
+	name         string
 	FetchServers []*FetchServer
 	Sites        *httpproxy.HostMatcher
 }
 
 func init() {
-	filename := filterName + ".json"
-	config := new(Config)
-	err := storage.ReadJsonConfig(filters.LookupConfigStoreURI(filterName), filename, config)
-	if err != nil {
-		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
-	}
-
-	err = filters.Register(filterName, &filters.RegisteredFilter{
-		New: func() (filters.Filter, error) {
-			return NewFilter(config)
+	err := filters.Register(filterName, &filters.RegisteredFilter{
+		New: func(name string) (filters.Filter, error) {
+			config := new(Config)
+			if err := filters.ReadConfig(name, config); err != nil {
+				return nil, err
+			}
+			return NewFilter(name, config)
 		},
 	})
 
@@ -54,7 +51,7 @@ func init() {
 	}
 }
 
-func NewFilter(config *Config) (filters.Filter, error) {
+func NewFilter(name string, config *Config) (filters.Filter, error) {
 	fetchServers := make([]*FetchServer, 0)
 	for _, fs := range config.FetchServers {
 		u, err := url.Parse(fs.URL)
@@ -81,17 +78,18 @@ func NewFilter(config *Config) (filters.Filter, error) {
 	}
 
 	return &Filter{
+		name:         name,
 		FetchServers: fetchServers,
 		Sites:        httpproxy.NewHostMatcher(config.Sites),
 	}, nil
 }
 
 func (p *Filter) FilterName() string {
-	return filterName
+	return p.name
 }
 
 func (f *Filter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Response, error) {
-	if !f.Sites.Match(req.Host) {
+	if ctx.GetRoundTripFilter() != f && !f.Sites.Match(req.Host) {
 		return ctx, nil, nil
 	}
 
@@ -157,11 +155,10 @@ func (f *Filter) RoundTrip(ctx *filters.Context, req *http.Request) (*filters.Co
 	// 	ctx.SetHijacked(true)
 	// 	return ctx, nil, nil
 	// }
+	ctx.SetUpstream(fetchServer.URL.Host)
 	resp, err := fetchServer.RoundTrip(req)
 	if err != nil {
 		return ctx, nil, err
-	} else {
-		glog.Infof("%s \"VPS %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
 	}
 	return ctx, resp, err
 }
@@ -1,29 +1,136 @@
 package httpproxy
 
 import (
+	"context"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/golang/glog"
 
 	"./filters"
+	"./metrics"
 )
 
-type Handler struct {
-	http.Handler
-	Listener         Listener
+var (
+	requestsTotal   = metrics.NewCounter("goproxy_requests_total", "Requests handled, by filter and status class.", "filter", "code")
+	requestDuration = metrics.NewHistogram("goproxy_request_duration_seconds", "Request latency, by filter and status class.", nil, "filter", "code")
+	tunnelsActive   = metrics.NewGauge("goproxy_tunnels_active", "Active CONNECT tunnels.")
+	relayedBytes    = metrics.NewCounter("goproxy_relayed_bytes_total", "Bytes relayed by tunnels and upgraded connections, by direction.", "direction")
+)
+
+type Chain struct {
 	RequestFilters   []filters.RequestFilter
 	RoundTripFilters []filters.RoundTripFilter
 	ResponseFilters  []filters.ResponseFilter
+	// Middlewares wrap the RoundTrip filters, the first one is the outermost
+	Middlewares []filters.MiddlewareFilter
+	Router      *Router
+	Failover    *Failover
+	// Timeouts are the deadlines of RoundTrip filters, counted from the time
+	// each one is tried and covering the response body
+	Timeouts map[filters.Filter]time.Duration
+	// Filters are all the filters used by the chain by name
+	Filters map[string]filters.Filter
+}
+
+type Handler struct {
+	http.Handler
+	// Name of the listener, handlers of one process have distinct names
+	Name      string
+	Listener  Listener
+	AccessLog *AccessLog
+	Conns     *ConnTable
+	chain     atomic.Value
+	active    int64
+}
+
+func NewHandler(ln Listener, chain *Chain) *Handler {
+	h := &Handler{
+		Listener: ln,
+		Conns:    NewConnTable(),
+	}
+	h.SetChain(chain)
+	return h
 }
 
-func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+// SetChain atomically replaces the filter chain, in-flight requests keep the
+// chain they started with.
+func (h *Handler) SetChain(chain *Chain) {
+	h.chain.Store(chain)
+}
+
+func (h *Handler) Chain() *Chain {
+	return h.chain.Load().(*Chain)
+}
+
+// Active returns the number of in-flight requests, including CONNECT tunnels.
+func (h *Handler) Active() int64 {
+	return atomic.LoadInt64(&h.active)
+}
+
+// CheckCredential reports whether the CredentialFilters of the chain accept
+// username and password from remoteAddr, true if there are none.
+func (h *Handler) CheckCredential(remoteAddr, username, password string) bool {
+	chain := h.Chain()
+	fs := make([]filters.Filter, 0, len(chain.RoundTripFilters)+len(chain.Middlewares))
+	for _, f := range chain.Middlewares {
+		if u, ok := f.(interface {
+			Unwrap() filters.Filter
+		}); ok {
+			fs = append(fs, u.Unwrap())
+		}
+	}
+	for _, f := range chain.RoundTripFilters {
+		fs = append(fs, f)
+	}
+	for _, f := range fs {
+		if cf, ok := f.(CredentialFilter); ok && !cf.CheckCredential(remoteAddr, username, password) {
+			return false
+		}
+	}
+	return true
+}
+
+// Wait blocks until all in-flight requests finished or ctx is done.
+func (h *Handler) Wait(ctx context.Context) error {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for h.Active() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	var err error
 
+	atomic.AddInt64(&h.active, 1)
+	defer atomic.AddInt64(&h.active, -1)
+
 	remoteAddr := req.RemoteAddr
+	chain := h.Chain()
+
+	crw := &countingResponseWriter{ResponseWriter: rw}
+	rw = crw
+	if req.Body != nil {
+		req.Body = &countingReadCloser{req.Body, &crw.bytesIn}
+	}
 
 	// Prepare filter.Context
 	ctx := filters.NewContext(h.Listener, rw, req)
+	defer ctx.Cancel()
+	req = req.WithContext(ctx.Context())
+	crw.onHijack = func(conn net.Conn) {
+		ctx.AddCloser(conn)
+	}
 
 	// Enable transport http proxy
 	if req.Method != "CONNECT" && !req.URL.IsAbs() {
@@ -45,11 +152,40 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	if req.Method == "CONNECT" {
+		tunnelsActive.Inc()
+		defer tunnelsActive.Dec()
+	}
+
+	var filterName string
+	start, req0 := time.Now(), req
+	uri := req.URL.String()
+	if req.Method == "CONNECT" {
+		uri = req.Host
+	}
+	defer func() {
+		h.record(ctx, crw, req0, uri, start, filterName, err)
+	}()
+
+	e := &connEntry{
+		listener: h.Name,
+		client:   req.RemoteAddr,
+		method:   req.Method,
+		target:   uri,
+		start:    start,
+		ctx:      ctx,
+		rw:       crw,
+	}
+	h.Conns.add(e)
+	defer h.Conns.remove(e)
+
 	// Filter Request
-	for _, f := range h.RequestFilters {
+	for _, f := range chain.RequestFilters {
+		e.setFilter(f.FilterName())
 		ctx, req, err = f.Request(ctx, req)
 		// A roundtrip filter hijacked
 		if ctx.Hijacked() {
+			filterName = f.FilterName()
 			return
 		}
 		if err != nil {
@@ -66,26 +202,16 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 
 	// Filter Request -> Response
 	var resp *http.Response
-	for _, f := range h.RoundTripFilters {
-		ctx, resp, err = f.RoundTrip(ctx, req)
-		// A roundtrip filter hijacked
-		if ctx.Hijacked() {
-			return
-		}
-		// Unexcepted errors
-		if err != nil {
-			glog.Errorf("%s Filter RoundTrip %T(%v) error: %v", remoteAddr, f, f, err)
-			return
-		}
-		// A roundtrip filter give a response
-		if resp != nil {
-			resp.Request = req
-			break
-		}
+	roundTrip := func(ctx *filters.Context, req *http.Request) (*filters.Context, *http.Response, error) {
+		return h.roundTrip(chain, e, &filterName, ctx, req)
+	}
+	ctx, resp, err = filters.Wrap(chain.Middlewares, roundTrip)(ctx, req)
+	if ctx.Hijacked() || err != nil {
+		return
 	}
 
 	// Filter Response
-	for _, f := range h.ResponseFilters {
+	for _, f := range chain.ResponseFilters {
 		if resp == nil {
 			return
 		}
@@ -108,9 +234,154 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	rw.WriteHeader(resp.StatusCode)
 	if resp.Body != nil {
 		defer resp.Body.Close()
-		n, err := IoCopy(rw, resp.Body)
+		var n int64
+		n, err = IoCopy(rw, resp.Body)
 		if err != nil {
 			glog.Errorf("IoCopy %#v return %#v %s", resp.Body, n, err)
 		}
 	}
 }
+
+// roundTrip runs the RoundTrip filters of chain with routing and failover, it
+// is the innermost handler of chain.Middlewares.
+func (h *Handler) roundTrip(chain *Chain, e *connEntry, filterName *string, ctx *filters.Context, req *http.Request) (*filters.Context, *http.Response, error) {
+	remoteAddr := req.RemoteAddr
+	var resp, failed *http.Response
+	var err error
+	var rule *Rule
+	var rewind func()
+	replayable := false
+	if chain.Failover != nil {
+		rewind, replayable = chain.Failover.Prepare(req)
+	}
+	routed := false
+	for _, f := range chain.RoundTripFilters {
+		// Route on the first routable filter, so filters before it (e.g. auth) already ran
+		if chain.Router != nil && chain.Router.IsTarget(f) {
+			if !routed {
+				routed = true
+				if rule = chain.Router.Route(ctx, req); rule != nil {
+					glog.V(2).Infof("%s route %s %s to %s by rule %#v", remoteAddr, req.Method, req.Host, rule.Filter.FilterName(), rule.Name)
+					ctx.SetRoute(rule.Name, rule.Filter)
+				}
+			}
+			if rule != nil && rule.Filter != f {
+				continue
+			}
+		}
+		if replayable {
+			rewind()
+		}
+		*filterName = f.FilterName()
+		e.setFilter(*filterName)
+		roundTrip := f.RoundTrip
+		if rule != nil && len(rule.Middlewares) > 0 {
+			roundTrip = filters.Wrap(rule.Middlewares, f.RoundTrip)
+		}
+		ctx.SetTimeout(chain.Timeouts[f])
+		ctx, resp, err = roundTrip(ctx, req.WithContext(ctx.Context()))
+		// A roundtrip filter hijacked
+		if ctx.Hijacked() {
+			if failed != nil && failed.Body != nil {
+				failed.Body.Close()
+			}
+			return ctx, nil, nil
+		}
+		// Unexcepted errors
+		if err != nil {
+			if replayable {
+				glog.Warningf("%s Filter RoundTrip %T(%v) error: %v, failover to next filter", remoteAddr, f, f, err)
+				continue
+			}
+			glog.Errorf("%s Filter RoundTrip %T(%v) error: %v", remoteAddr, f, f, err)
+			return ctx, nil, err
+		}
+		// A roundtrip filter give a response
+		if resp != nil {
+			if replayable && chain.Failover.Match(resp) {
+				glog.Warningf("%s Filter RoundTrip %T(%v) return %s, failover to next filter", remoteAddr, f, f, resp.Status)
+				if failed != nil && failed.Body != nil {
+					failed.Body.Close()
+				}
+				failed, resp = resp, nil
+				continue
+			}
+			resp.Request = req
+			break
+		}
+	}
+
+	// All filters failed, reply the last failed response
+	if resp == nil && failed != nil {
+		resp, failed = failed, nil
+		resp.Request = req
+	}
+	if failed != nil && failed.Body != nil {
+		failed.Body.Close()
+	}
+	if resp == nil && err != nil {
+		glog.Errorf("%s Filter RoundTrip %s %s error: %v", remoteAddr, req.Method, req.Host, err)
+		return ctx, nil, err
+	}
+
+	// Filter Response of the route
+	if rule != nil {
+		for _, f := range rule.ResponseFilters {
+			if resp == nil {
+				break
+			}
+			ctx, resp, err = f.Response(ctx, resp)
+			if err != nil {
+				glog.Errorf("%s Filter Response %T(%v) error: %v", remoteAddr, f, f, err)
+				return ctx, nil, err
+			}
+		}
+	}
+
+	return ctx, resp, nil
+}
+
+// record updates metrics and writes the access log of a finished request.
+func (h *Handler) record(ctx *filters.Context, rw *countingResponseWriter, req *http.Request, uri string, start time.Time, filterName string, err error) {
+	duration := time.Since(start)
+	bytesIn, bytesOut := atomic.LoadInt64(&rw.bytesIn), atomic.LoadInt64(&rw.bytesOut)
+
+	name := filterName
+	if name == "" {
+		name = "none"
+	}
+	code := strconv.Itoa(rw.Status()/100) + "xx"
+	requestsTotal.Inc(name, code)
+	requestDuration.Observe(duration.Seconds(), name, code)
+
+	if req.Method == "CONNECT" || rw.hijacked {
+		relayedBytes.Add(float64(bytesIn), "in")
+		relayedBytes.Add(float64(bytesOut), "out")
+	}
+
+	if h.AccessLog == nil {
+		return
+	}
+
+	e := &AccessLogEntry{
+		Time:      start,
+		Client:    req.RemoteAddr,
+		User:      ctx.GetUsername(),
+		Method:    req.Method,
+		URL:       uri,
+		Proto:     req.Proto,
+		Status:    rw.Status(),
+		BytesIn:   bytesIn,
+		BytesOut:  bytesOut,
+		Duration:  duration.Seconds(),
+		Filter:    filterName,
+		Route:     ctx.GetRoute(),
+		Upstream:  ctx.GetUpstream(),
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+	}
+	if err != nil && err != io.EOF {
+		e.Error = err.Error()
+	}
+	h.AccessLog.Log(e)
+}
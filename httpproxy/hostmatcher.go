@@ -1,18 +1,55 @@
 package httpproxy
 
 import (
+	"net"
 	"path"
 	"strings"
 )
 
+// HostMatcher looks up values by host, keys are
+//
+//	"*"                every host
+//	"example.com"      the host itself
+//	"*.example.com"    subdomains of example.com
+//	"*example.com"     example.com and its subdomains
+//	"www.example.*"    labels matched by path.Match, one label per pattern label
+//	"10.0.0.0/8"       IP hosts in the network, a bare IP is a /32 or /128
+//
+// and each of them may carry a port, e.g. "example.com:443" or "[::1]:8080",
+// to match only hosts with that port. Domains are matched on label
+// boundaries, so "*example.com" does not match "badexample.com".
+//
+// A lookup returns the value of the most specific key: port keys win over
+// portless ones, then the longer domain or network wins, then an exact host
+// wins over a wildcard at the same depth, and literal labels win over globs.
 type HostMatcher struct {
-	all0       interface{}
-	list1_keys []string
-	list1_map  map[string]interface{}
-	list2_keys []string
-	list2_map  map[string]interface{}
-	list3_keys []string
-	list3_map  map[string]interface{}
+	trie  *hostNode
+	ports map[string]*hostNode
+	nets  []hostNet
+}
+
+type hostNode struct {
+	children map[string]*hostNode
+	globs    []hostGlob
+	exact    *hostValue
+	wild     *hostValue // "*.domain", any subdomain
+	apex     *hostValue // "*domain", the domain itself
+	all      *hostValue // "*", any host
+}
+
+type hostGlob struct {
+	pattern string
+	node    *hostNode
+}
+
+type hostValue struct {
+	value interface{}
+}
+
+type hostNet struct {
+	ipnet *net.IPNet
+	port  string
+	value interface{}
 }
 
 func NewHostMatcher(hosts []string) *HostMatcher {
@@ -33,32 +70,128 @@ func NewHostMatcherWithString(hosts map[string]string) *HostMatcher {
 
 func NewHostMatcherWithValue(values map[string]interface{}) *HostMatcher {
 	hm := &HostMatcher{
-		all0:       nil,
-		list1_keys: make([]string, 0),
-		list1_map:  make(map[string]interface{}),
-		list2_keys: make([]string, 0),
-		list2_map:  make(map[string]interface{}),
-		list3_keys: make([]string, 0),
-		list3_map:  make(map[string]interface{}),
+		trie:  newHostNode(),
+		ports: make(map[string]*hostNode),
 	}
 
 	for key, value := range values {
+		hm.add(key, value)
+	}
+
+	return hm
+}
+
+func newHostNode() *hostNode {
+	return &hostNode{
+		children: make(map[string]*hostNode),
+	}
+}
+
+func (hm *HostMatcher) add(key string, value interface{}) {
+	host, port := splitHostPort(strings.ToLower(strings.TrimSpace(key)))
+	host = strings.TrimSuffix(host, ".")
+
+	if strings.Contains(host, "/") {
+		if _, ipnet, err := net.ParseCIDR(host); err == nil {
+			hm.nets = append(hm.nets, hostNet{ipnet, port, value})
+			return
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		hm.nets = append(hm.nets, hostNet{&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, port, value})
+		return
+	}
+
+	root := hm.trie
+	if port != "" {
+		if root = hm.ports[port]; root == nil {
+			root = newHostNode()
+			hm.ports[port] = root
+		}
+	}
+
+	v := &hostValue{value}
+	switch {
+	case host == "*":
+		root.all = v
+	case strings.HasPrefix(host, "*.") && !strings.Contains(host[2:], "*"):
+		root.insert(host[2:]).wild = v
+	case strings.HasPrefix(host, "*") && !strings.Contains(host[1:], "*"):
+		n := root.insert(host[1:])
+		n.wild, n.apex = v, v
+	default:
+		root.insert(host).exact = v
+	}
+}
+
+// insert returns the node of domain, creating the path from its last label.
+func (n *hostNode) insert(domain string) *hostNode {
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		label := labels[i]
+		if strings.ContainsAny(label, "*?[") {
+			var child *hostNode
+			for _, g := range n.globs {
+				if g.pattern == label {
+					child = g.node
+				}
+			}
+			if child == nil {
+				child = newHostNode()
+				n.globs = append(n.globs, hostGlob{label, child})
+			}
+			n = child
+			continue
+		}
+		child, ok := n.children[label]
+		if !ok {
+			child = newHostNode()
+			n.children[label] = child
+		}
+		n = child
+	}
+	return n
+}
+
+// lookup matches labels from the last one, it returns the value of the most
+// specific key and its depth, exact matches count half a label deeper.
+func (n *hostNode) lookup(labels []string, depth int) (*hostValue, int) {
+	var best *hostValue
+	bestDepth := -1
+
+	if len(labels) == 0 {
 		switch {
-		case key == "*":
-			hm.all0 = value
-		case !strings.Contains(key, "*"):
-			hm.list1_keys = append(hm.list1_keys, key)
-			hm.list1_map[key] = value
-		case strings.HasPrefix(key, "*") && !strings.Contains(key[1:], "*"):
-			hm.list2_keys = append(hm.list2_keys, key[1:])
-			hm.list2_map[key[1:]] = value
-		default:
-			hm.list3_keys = append(hm.list3_keys, key)
-			hm.list3_map[key] = value
+		case n.exact != nil:
+			return n.exact, 2*depth + 1
+		case n.apex != nil:
+			return n.apex, 2 * depth
 		}
+		return nil, -1
 	}
 
-	return hm
+	if n.wild != nil {
+		best, bestDepth = n.wild, 2*depth
+	}
+
+	label, rest := labels[len(labels)-1], labels[:len(labels)-1]
+	if child, ok := n.children[label]; ok {
+		if v, d := child.lookup(rest, depth+1); d > bestDepth {
+			best, bestDepth = v, d
+		}
+	}
+	for _, g := range n.globs {
+		if matched, _ := path.Match(g.pattern, label); matched {
+			if v, d := g.node.lookup(rest, depth+1); d > bestDepth {
+				best, bestDepth = v, d
+			}
+		}
+	}
+
+	return best, bestDepth
 }
 
 func (hm *HostMatcher) Match(host string) bool {
@@ -67,25 +200,60 @@ func (hm *HostMatcher) Match(host string) bool {
 }
 
 func (hm *HostMatcher) Lookup(host string) (interface{}, bool) {
-	if hm.all0 != nil {
-		return hm.all0, true
-	}
+	host, port := splitHostPort(strings.ToLower(host))
+	host = strings.TrimSuffix(host, ".")
 
-	if value, ok := hm.list1_map[host]; ok {
-		return value, true
+	if ip := net.ParseIP(host); ip != nil {
+		if value, ok := hm.lookupIP(ip, port); ok {
+			return value, true
+		}
 	}
 
-	for _, key := range hm.list2_keys {
-		if strings.HasSuffix(host, key) {
-			return hm.list2_map[key], true
+	labels := strings.Split(host, ".")
+	for _, root := range []*hostNode{hm.ports[port], hm.trie} {
+		if root == nil {
+			continue
+		}
+		if v, _ := root.lookup(labels, 0); v != nil {
+			return v.value, true
+		}
+		if root.all != nil {
+			return root.all.value, true
 		}
 	}
 
-	for _, key := range hm.list3_keys {
-		if matched, _ := path.Match(key, host); matched {
-			return hm.list3_map[key], true
+	return nil, false
+}
+
+func (hm *HostMatcher) lookupIP(ip net.IP, port string) (interface{}, bool) {
+	var best *hostNet
+	bestOnes := -1
+	for i := range hm.nets {
+		n := &hm.nets[i]
+		if n.port != "" && n.port != port || !n.ipnet.Contains(ip) {
+			continue
+		}
+		ones, _ := n.ipnet.Mask.Size()
+		if n.port != "" {
+			ones += 129
+		}
+		if ones > bestOnes {
+			best, bestOnes = n, ones
 		}
 	}
+	if best == nil {
+		return nil, false
+	}
+	return best.value, true
+}
 
-	return nil, false
+// splitHostPort splits "host:port" and "[ipv6]:port", hosts without a port
+// are returned as they are.
+func splitHostPort(s string) (host, port string) {
+	if strings.Count(s, ":") == 1 || strings.HasPrefix(s, "[") {
+		if h, p, err := net.SplitHostPort(s); err == nil {
+			return h, p
+		}
+	}
+	return strings.Trim(s, "[]"), ""
 }
@@ -0,0 +1,110 @@
+package httpproxy
+
+import (
+	"testing"
+)
+
+func TestHostMatcherLookup(t *testing.T) {
+	hm := NewHostMatcherWithString(map[string]string{
+		"*":                 "all",
+		"example.com":       "exact",
+		"*.example.com":     "wild",
+		"*example.org":      "apex",
+		"www.example.org":   "www.example.org",
+		"example.com:8080":  "exact:8080",
+		"*.example.com:443": "wild:443",
+		"*.example.net":     "wild.net",
+		"www.example.*":     "glob",
+		"cdn?.example.net":  "glob.net",
+		"cdn1.example.net":  "cdn1",
+		"10.0.0.0/8":        "10/8",
+		"10.1.0.0/16":       "10.1/16",
+		"10.1.2.3":          "10.1.2.3",
+		"10.2.0.0/16:443":   "10.2/16:443",
+		"::1":               "::1",
+		"[::1]:8080":        "::1:8080",
+		"2001:db8::/32":     "2001:db8::/32",
+	})
+
+	tests := []struct {
+		host  string
+		value string
+	}{
+		// label boundaries
+		{"example.com", "exact"},
+		{"EXAMPLE.com.", "exact"},
+		{"mail.example.com", "wild"},
+		{"a.b.example.com", "wild"},
+		{"badexample.com", "all"},
+		{"example.org", "apex"},
+		{"mail.example.org", "apex"},
+		{"badexample.org", "all"},
+		// the deeper key wins, exact over wildcard at the same depth
+		{"www.example.org", "www.example.org"},
+		// port keys win over portless ones
+		{"example.com:8080", "exact:8080"},
+		{"example.com:80", "exact"},
+		{"www.example.com:443", "wild:443"},
+		{"mail.example.com:80", "wild"},
+		{"example.com:443", "exact"},
+		// literal labels win over globs
+		{"cdn1.example.net", "cdn1"},
+		{"cdn2.example.net", "glob.net"},
+		{"cdn22.example.net", "wild.net"},
+		{"www.example.io", "glob"},
+		// a deeper glob wins over a shallower wildcard
+		{"www.example.com", "glob"},
+		// the longest prefix wins
+		{"10.9.9.9", "10/8"},
+		{"10.1.9.9", "10.1/16"},
+		{"10.1.2.3", "10.1.2.3"},
+		{"10.1.2.3:80", "10.1.2.3"},
+		{"10.2.0.1:443", "10.2/16:443"},
+		{"10.2.0.1:80", "10/8"},
+		{"192.168.0.1", "all"},
+		// IPv6 with and without ports
+		{"::1", "::1"},
+		{"[::1]", "::1"},
+		{"[::1]:8080", "::1:8080"},
+		{"[::1]:80", "::1"},
+		{"2001:db8::5", "2001:db8::/32"},
+		{"[2001:db8::5]:443", "2001:db8::/32"},
+	}
+
+	for _, tt := range tests {
+		v, ok := hm.Lookup(tt.host)
+		if !ok {
+			t.Errorf("Lookup(%q) not found, want %q", tt.host, tt.value)
+			continue
+		}
+		if v.(string) != tt.value {
+			t.Errorf("Lookup(%q) = %q, want %q", tt.host, v, tt.value)
+		}
+	}
+}
+
+func TestHostMatcherMatch(t *testing.T) {
+	hm := NewHostMatcher([]string{"*example.com", "10.0.0.0/8", "[::1]:8080"})
+
+	tests := []struct {
+		host  string
+		match bool
+	}{
+		{"example.com", true},
+		{"www.example.com", true},
+		{"badexample.com", false},
+		{"example.com.cn", false},
+		{"10.0.0.1", true},
+		{"11.0.0.1", false},
+		{"[::1]:8080", true},
+		{"[::1]:80", false},
+		{"::1", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := hm.Match(tt.host); got != tt.match {
+			t.Errorf("Match(%q) = %v, want %v", tt.host, got, tt.match)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -33,7 +34,9 @@ type racer struct {
 
 type listener struct {
 	ln              net.Listener
+	ln0             net.Listener
 	lane            chan racer
+	done            chan struct{}
 	keepAlivePeriod time.Duration
 	stopped         bool
 	once            sync.Once
@@ -43,6 +46,33 @@ type listener struct {
 type ListenOptions struct {
 	TLSConfig       *tls.Config
 	KeepAlivePeriod time.Duration
+	// ProxyProtocol requires PROXY protocol v1/v2 headers of connections from
+	// TrustedProxies, no source is trusted if TrustedProxies is empty.
+	ProxyProtocol  bool
+	TrustedProxies []*net.IPNet
+	// Mode is the permissions of unix socket files, the umask applies if zero.
+	Mode os.FileMode
+}
+
+// Listen announces on the local network address, network is "tcp", "tcp4",
+// "tcp6" or "unix".
+func Listen(network, addr string, opts *ListenOptions) (Listener, error) {
+	switch network {
+	case "", "tcp", "tcp4", "tcp6":
+		if network == "" {
+			network = "tcp"
+		}
+		return ListenTCP(network, addr, opts)
+	case "unix":
+		return ListenUnix(network, addr, opts)
+	}
+
+	ln0, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return newListener(ln0, opts), nil
 }
 
 func ListenTCP(network, addr string, opts *ListenOptions) (Listener, error) {
@@ -56,11 +86,63 @@ func ListenTCP(network, addr string, opts *ListenOptions) (Listener, error) {
 		return nil, err
 	}
 
-	var ln net.Listener
+	return newListener(ln0, opts), nil
+}
+
+// ListenUnix listens on the unix socket file addr, a stale socket file left by
+// a dead process is removed first. The file is kept when the listener closes,
+// so that a gracefully restarted process can keep serving it.
+func ListenUnix(network, addr string, opts *ListenOptions) (Listener, error) {
+	abstract := strings.HasPrefix(addr, "@")
+	if !abstract {
+		if fi, err := os.Stat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.DialTimeout(network, addr, time.Second); err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("httpproxy.Listener: %s is in use", addr)
+			}
+			os.Remove(addr)
+		}
+	}
+
+	laddr, err := net.ResolveUnixAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ln0, err := net.ListenUnix(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	ln0.SetUnlinkOnClose(false)
+
+	if !abstract && opts != nil && opts.Mode != 0 {
+		if err := os.Chmod(addr, opts.Mode); err != nil {
+			ln0.Close()
+			os.Remove(addr)
+			return nil, err
+		}
+	}
+
+	return newListener(ln0, opts), nil
+}
+
+// FileListener returns a Listener of the inherited listening socket f.
+func FileListener(f *os.File, opts *ListenOptions) (Listener, error) {
+	ln0, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return newListener(ln0, opts), nil
+}
+
+func newListener(ln0 net.Listener, opts *ListenOptions) *listener {
+	ln := ln0
+	if opts != nil && opts.ProxyProtocol {
+		ln = &proxyListener{Listener: ln, trusted: opts.TrustedProxies}
+	}
 	if opts != nil && opts.TLSConfig != nil {
-		ln = tls.NewListener(ln0, opts.TLSConfig)
-	} else {
-		ln = ln0
+		ln = tls.NewListener(ln, opts.TLSConfig)
 	}
 
 	var keepAlivePeriod time.Duration
@@ -70,13 +152,14 @@ func ListenTCP(network, addr string, opts *ListenOptions) (Listener, error) {
 
 	l := &listener{
 		ln:              ln,
+		ln0:             ln0,
 		lane:            make(chan racer, backlog),
+		done:            make(chan struct{}),
 		stopped:         false,
 		keepAlivePeriod: keepAlivePeriod,
 	}
 
-	return l, nil
-
+	return l
 }
 
 func (l *listener) Accept() (c net.Conn, err error) {
@@ -85,7 +168,14 @@ func (l *listener) Accept() (c net.Conn, err error) {
 			var tempDelay time.Duration
 			for {
 				conn, err := l.ln.Accept()
-				l.lane <- racer{conn, err}
+				select {
+				case l.lane <- racer{conn, err}:
+				case <-l.done:
+					if conn != nil {
+						conn.Close()
+					}
+					return
+				}
 				if err != nil {
 					if ne, ok := err.(net.Error); ok && ne.Temporary() {
 						if tempDelay == 0 {
@@ -106,13 +196,18 @@ func (l *listener) Accept() (c net.Conn, err error) {
 		}()
 	})
 
-	r := <-l.lane
+	var r racer
+	select {
+	case r = <-l.lane:
+	case <-l.done:
+		return nil, fmt.Errorf("httpproxy.Listener: %s already closed", l.ln.Addr())
+	}
 	if r.err != nil {
 		return r.conn, r.err
 	}
 
 	if l.keepAlivePeriod > 0 {
-		if tc, ok := r.conn.(*net.TCPConn); ok {
+		if tc, _ := unwrapWrite(r.conn); tc != nil {
 			tc.SetKeepAlive(true)
 			tc.SetKeepAlivePeriod(l.keepAlivePeriod)
 		}
@@ -128,7 +223,7 @@ func (l *listener) Close() error {
 		return nil
 	}
 	l.stopped = true
-	close(l.lane)
+	close(l.done)
 	return l.ln.Close()
 }
 
@@ -137,10 +232,10 @@ func (l *listener) Addr() net.Addr {
 }
 
 func (l *listener) File() (*os.File, error) {
-	if f, ok := l.ln.(filer); ok {
+	if f, ok := l.ln0.(filer); ok {
 		return f.File()
 	}
-	return nil, fmt.Errorf("%T does not has func File()", l.ln)
+	return nil, fmt.Errorf("%T does not has func File()", l.ln0)
 }
 
 func (l *listener) Add(conn net.Conn) error {
@@ -148,7 +243,7 @@ func (l *listener) Add(conn net.Conn) error {
 	defer l.mu.Unlock()
 
 	if l.stopped {
-		return fmt.Errorf("%#v already closed", l)
+		return fmt.Errorf("httpproxy.Listener: %s already closed", l.ln.Addr())
 	}
 
 	l.lane <- racer{conn, nil}
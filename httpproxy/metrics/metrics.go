@@ -0,0 +1,341 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type Metric interface {
+	Name() string
+	WriteText(w io.Writer) error
+}
+
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]Metric
+}
+
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: make(map[string]Metric),
+	}
+}
+
+func (r *Registry) Register(m Metric) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.metrics[m.Name()]; ok {
+		return fmt.Errorf("metric %#v already registered", m.Name())
+	}
+	r.metrics[m.Name()] = m
+	return nil
+}
+
+// WriteText writes all metrics in the Prometheus text exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		r.mu.Lock()
+		m := r.metrics[name]
+		r.mu.Unlock()
+		if err := m.WriteText(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Registry) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(rw)
+	r.WriteText(bw)
+	bw.Flush()
+}
+
+func MustRegister(m Metric) {
+	if err := DefaultRegistry.Register(m); err != nil {
+		panic(err)
+	}
+}
+
+func Handler() http.Handler {
+	return DefaultRegistry
+}
+
+// vec keeps one value per combination of label values.
+type vec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+	mu     sync.Mutex
+	keys   []string
+	values map[string]interface{}
+}
+
+func newVec(name, help, typ string, labels []string) vec {
+	return vec{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		values: make(map[string]interface{}),
+	}
+}
+
+func (v *vec) Name() string {
+	return v.name
+}
+
+func (v *vec) get(values []string, new func() interface{}) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %#v expects labels %v, got %v", v.name, v.labels, values))
+	}
+
+	key := strings.Join(values, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	value, ok := v.values[key]
+	if !ok {
+		value = new()
+		v.values[key] = value
+		v.keys = append(v.keys, key)
+		sort.Strings(v.keys)
+	}
+	return value
+}
+
+func (v *vec) each(f func(labels string, value interface{}) error) error {
+	v.mu.Lock()
+	keys := append([]string(nil), v.keys...)
+	v.mu.Unlock()
+
+	for _, key := range keys {
+		v.mu.Lock()
+		value := v.values[key]
+		v.mu.Unlock()
+
+		if err := f(v.formatLabels(key), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *vec) formatLabels(key string) string {
+	if len(v.labels) == 0 {
+		return ""
+	}
+	values := strings.Split(key, "\xff")
+	parts := make([]string, len(v.labels))
+	for i, label := range v.labels {
+		parts[i] = label + "=" + quoteLabel(values[i])
+	}
+	return strings.Join(parts, ",")
+}
+
+func (v *vec) writeHeader(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.typ)
+	return err
+}
+
+type value struct {
+	mu sync.Mutex
+	v  float64
+}
+
+func (v *value) add(delta float64) {
+	v.mu.Lock()
+	v.v += delta
+	v.mu.Unlock()
+}
+
+func (v *value) set(x float64) {
+	v.mu.Lock()
+	v.v = x
+	v.mu.Unlock()
+}
+
+func (v *value) get() float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.v
+}
+
+type Counter struct {
+	vec
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newVec(name, help, "counter", labels)}
+	MustRegister(c)
+	return c
+}
+
+func (c *Counter) Add(delta float64, values ...string) {
+	c.get(values, func() interface{} { return new(value) }).(*value).add(delta)
+}
+
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *Counter) WriteText(w io.Writer) error {
+	if err := c.writeHeader(w); err != nil {
+		return err
+	}
+	return c.each(func(labels string, v interface{}) error {
+		return writeSample(w, c.name, labels, v.(*value).get())
+	})
+}
+
+type Gauge struct {
+	vec
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newVec(name, help, "gauge", labels)}
+	MustRegister(g)
+	return g
+}
+
+func (g *Gauge) Add(delta float64, values ...string) {
+	g.get(values, func() interface{} { return new(value) }).(*value).add(delta)
+}
+
+func (g *Gauge) Set(x float64, values ...string) {
+	g.get(values, func() interface{} { return new(value) }).(*value).set(x)
+}
+
+func (g *Gauge) Inc(values ...string) {
+	g.Add(1, values...)
+}
+
+func (g *Gauge) Dec(values ...string) {
+	g.Add(-1, values...)
+}
+
+func (g *Gauge) WriteText(w io.Writer) error {
+	if err := g.writeHeader(w); err != nil {
+		return err
+	}
+	return g.each(func(labels string, v interface{}) error {
+		return writeSample(w, g.name, labels, v.(*value).get())
+	})
+}
+
+type histogramValue struct {
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type Histogram struct {
+	vec
+	Buckets []float64
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &Histogram{newVec(name, help, "histogram", labels), buckets}
+	MustRegister(h)
+	return h
+}
+
+func (h *Histogram) Observe(x float64, values ...string) {
+	hv := h.get(values, func() interface{} {
+		return &histogramValue{counts: make([]uint64, len(h.Buckets))}
+	}).(*histogramValue)
+
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	for i, le := range h.Buckets {
+		if x <= le {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += x
+}
+
+func (h *Histogram) WriteText(w io.Writer) error {
+	if err := h.writeHeader(w); err != nil {
+		return err
+	}
+	return h.each(func(labels string, v interface{}) error {
+		hv := v.(*histogramValue)
+		hv.mu.Lock()
+		counts := append([]uint64(nil), hv.counts...)
+		count, sum := hv.count, hv.sum
+		hv.mu.Unlock()
+
+		prefix := labels
+		if prefix != "" {
+			prefix += ","
+		}
+		for i, le := range h.Buckets {
+			if err := writeSample(w, h.name+"_bucket", prefix+"le="+quoteLabel(formatFloat(le)), float64(counts[i])); err != nil {
+				return err
+			}
+		}
+		if err := writeSample(w, h.name+"_bucket", prefix+`le="+Inf"`, float64(count)); err != nil {
+			return err
+		}
+		if err := writeSample(w, h.name+"_sum", labels, sum); err != nil {
+			return err
+		}
+		return writeSample(w, h.name+"_count", labels, float64(count))
+	})
+}
+
+func writeSample(w io.Writer, name, labels string, x float64) error {
+	var err error
+	if labels == "" {
+		_, err = fmt.Fprintf(w, "%s %s\n", name, formatFloat(x))
+	} else {
+		_, err = fmt.Fprintf(w, "%s{%s} %s\n", name, labels, formatFloat(x))
+	}
+	return err
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quoteLabel quotes a label value, the exposition format only escapes
+// backslash, double quote and line feed.
+func quoteLabel(s string) string {
+	return `"` + labelEscaper.Replace(s) + `"`
+}
+
+func formatFloat(x float64) string {
+	switch {
+	case math.IsInf(x, 1):
+		return "+Inf"
+	case math.IsInf(x, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(x, 'g', -1, 64)
+}
@@ -0,0 +1,215 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	proxyHeaderTimeout = 10 * time.Second
+	proxyV1MaxLen      = 107
+)
+
+var (
+	proxyV2Sig            = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	errMissingProxyHeader = errors.New("missing PROXY header")
+)
+
+// proxyListener reads PROXY protocol v1/v2 headers of connections from
+// trusted sources, a nil trusted list trusts no source.
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+
+	if !l.trust(conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	return &proxyConn{Conn: conn}, nil
+}
+
+func (l *proxyListener) trust(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, ipnet := range l.trusted {
+		if ipnet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn replaces the addresses of Conn with the ones in its PROXY header,
+// the header is read on first use and is required.
+type proxyConn struct {
+	net.Conn
+	r          *bufio.Reader
+	once       sync.Once
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	err        error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.r = bufio.NewReader(c.Conn)
+		c.remoteAddr, c.localAddr, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.err = fmt.Errorf("PROXY header from %s error: %v", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.init()
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyConn) unwrapRead() (net.Conn, []byte, *int64) {
+	c.init()
+	if c.err != nil {
+		return nil, nil, nil
+	}
+	data, _ := c.r.Peek(c.r.Buffered())
+	data = append([]byte(nil), data...)
+	c.r.Discard(len(data))
+	return c.Conn, data, nil
+}
+
+func (c *proxyConn) unwrapWrite() (net.Conn, *int64) {
+	return c.Conn, nil
+}
+
+// readProxyHeader reads a PROXY v1 or v2 header from r, it returns nil
+// addresses if the header does not carry addresses.
+func readProxyHeader(r *bufio.Reader) (remote, local net.Addr, err error) {
+	if b, err := r.Peek(len(proxyV2Sig)); err == nil && bytes.Equal(b, proxyV2Sig) {
+		return readProxyV2(r)
+	}
+	if b, err := r.Peek(6); err == nil && string(b) == "PROXY " {
+		return readProxyV1(r)
+	}
+	return nil, nil, errMissingProxyHeader
+}
+
+func readProxyV1(r *bufio.Reader) (remote, local net.Addr, err error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLen {
+			return nil, nil, fmt.Errorf("PROXY v1 header is longer than %d bytes", proxyV1MaxLen)
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("PROXY v1 header %q does not end with CRLF", line)
+	}
+
+	parts := strings.Split(string(line[:len(line)-2]), " ")
+	if len(parts) >= 2 && parts[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(parts) != 6 || (parts[1] != "TCP4" && parts[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid PROXY v1 header %q", line)
+	}
+
+	srcIP, dstIP := net.ParseIP(parts[2]), net.ParseIP(parts[3])
+	srcPort, err1 := strconv.ParseUint(parts[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(parts[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return nil, nil, fmt.Errorf("invalid PROXY v1 header %q", line)
+	}
+
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (remote, local net.Addr, err error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported PROXY v2 version %d", header[12]>>4)
+	}
+
+	data := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, nil, err
+	}
+
+	switch header[12] & 0x0f {
+	case 0x0:
+		// LOCAL, health checks of the proxy itself
+		return nil, nil, nil
+	case 0x1:
+	default:
+		return nil, nil, fmt.Errorf("unsupported PROXY v2 command %d", header[12]&0x0f)
+	}
+
+	switch header[13] {
+	case 0x11:
+		if len(data) < 12 {
+			return nil, nil, fmt.Errorf("PROXY v2 TCP4 addresses are too short")
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:4]), Port: int(binary.BigEndian.Uint16(data[8:10]))},
+			&net.TCPAddr{IP: net.IP(data[4:8]), Port: int(binary.BigEndian.Uint16(data[10:12]))}, nil
+	case 0x21:
+		if len(data) < 36 {
+			return nil, nil, fmt.Errorf("PROXY v2 TCP6 addresses are too short")
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:16]), Port: int(binary.BigEndian.Uint16(data[32:34]))},
+			&net.TCPAddr{IP: net.IP(data[16:32]), Port: int(binary.BigEndian.Uint16(data[34:36]))}, nil
+	default:
+		// UNSPEC or protocols other than TCP, keep the connection addresses
+		return nil, nil, nil
+	}
+}
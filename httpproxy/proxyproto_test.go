@@ -0,0 +1,91 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func proxyV2Header(command, family byte, addrs []byte) []byte {
+	b := append([]byte(nil), proxyV2Sig...)
+	b = append(b, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(b[14:16], uint16(len(addrs)))
+	return append(b, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tcp4 := []byte{
+		192, 168, 0, 1, // source
+		10, 0, 0, 1, // destination
+		0x30, 0x39, // 12345
+		0x01, 0xbb, // 443
+	}
+	tcp6 := make([]byte, 36)
+	copy(tcp6[0:16], net.ParseIP("2001:db8::1"))
+	copy(tcp6[16:32], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(tcp6[32:34], 12345)
+	binary.BigEndian.PutUint16(tcp6[34:36], 443)
+
+	tests := []struct {
+		name   string
+		header []byte
+		remote string
+		local  string
+		err    bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.168.0.1 10.0.0.1 12345 443\r\n"), "192.168.0.1:12345", "10.0.0.1:443", false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n"), "[2001:db8::1]:12345", "[2001:db8::2]:443", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", "", false},
+		{"v1 truncated", []byte("PROXY TCP4 192.168.0.1 10.0.0.1 12345"), "", "", true},
+		{"v1 without crlf", []byte("PROXY TCP4 192.168.0.1 10.0.0.1 12345 443\n"), "", "", true},
+		{"v1 oversized", []byte("PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLen) + "\r\n"), "", "", true},
+		{"v1 bad address", []byte("PROXY TCP4 192.168.0 10.0.0.1 12345 443\r\n"), "", "", true},
+		{"v1 bad port", []byte("PROXY TCP4 192.168.0.1 10.0.0.1 123456 443\r\n"), "", "", true},
+		{"v2 tcp4", proxyV2Header(0x1, 0x11, tcp4), "192.168.0.1:12345", "10.0.0.1:443", false},
+		{"v2 tcp6", proxyV2Header(0x1, 0x21, tcp6), "[2001:db8::1]:12345", "[2001:db8::2]:443", false},
+		{"v2 local", proxyV2Header(0x0, 0x00, nil), "", "", false},
+		{"v2 unspec", proxyV2Header(0x1, 0x00, nil), "", "", false},
+		{"v2 truncated header", proxyV2Header(0x1, 0x11, tcp4)[:14], "", "", true},
+		{"v2 truncated addresses", proxyV2Header(0x1, 0x11, tcp4)[:20], "", "", true},
+		{"v2 short addresses", proxyV2Header(0x1, 0x11, tcp4[:8]), "", "", true},
+		{"v2 bad version", append(append([]byte(nil), proxyV2Sig...), 0x11, 0x11, 0, 0), "", "", true},
+		{"v2 bad command", proxyV2Header(0x2, 0x11, tcp4), "", "", true},
+		{"missing", []byte("GET / HTTP/1.1\r\n\r\n"), "", "", true},
+		{"empty", nil, "", "", true},
+	}
+
+	for _, tt := range tests {
+		r := bufio.NewReader(bytes.NewReader(append(tt.header, "payload"...)))
+		remote, local, err := readProxyHeader(r)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: readProxyHeader() returned no error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: readProxyHeader() error: %v", tt.name, err)
+			continue
+		}
+		if got := addrString(remote); got != tt.remote {
+			t.Errorf("%s: remote = %q, want %q", tt.name, got, tt.remote)
+		}
+		if got := addrString(local); got != tt.local {
+			t.Errorf("%s: local = %q, want %q", tt.name, got, tt.local)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "payload" {
+			t.Errorf("%s: data after header = %q, want %q", tt.name, rest, "payload")
+		}
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
@@ -0,0 +1,203 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	redirectPeekTimeout = 3 * time.Second
+	tlsRecordHeaderLen  = 5
+	tlsMaxRecordLen     = 16384 + 2048
+)
+
+// ServeRedirect accepts connections redirected by iptables REDIRECT on ln.
+// The original destination is recovered with SO_ORIGINAL_DST, plain HTTP is
+// fed into the listener of h, other traffic is served by h as a CONNECT to
+// the TLS ServerName or the original destination.
+func ServeRedirect(ln net.Listener, h *Handler) error {
+	var tempDelay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				glog.Infof("httpproxy.ServeRedirect: Accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+		go serveRedirect(conn, h)
+	}
+}
+
+func serveRedirect(conn net.Conn, h *Handler) {
+	dst, err := originalDst(conn)
+	if err != nil {
+		glog.Warningf("%s originalDst error: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	if dst.String() == conn.LocalAddr().String() {
+		glog.Warningf("%s connect to redirect listener %s directly", conn.RemoteAddr(), dst)
+		conn.Close()
+		return
+	}
+
+	br := bufio.NewReaderSize(conn, tlsRecordHeaderLen+tlsMaxRecordLen)
+	pconn := &peekedConn{Conn: conn, r: br}
+
+	conn.SetReadDeadline(time.Now().Add(redirectPeekTimeout))
+	b, _ := br.Peek(8)
+	host := dst.IP.String()
+	switch {
+	case len(b) > 0 && b[0] == 0x16:
+		if b, err := br.Peek(tlsRecordHeaderLen); err == nil {
+			n := int(binary.BigEndian.Uint16(b[3:5]))
+			if b, err := br.Peek(tlsRecordHeaderLen + n); err == nil {
+				if name := readServerName(b[tlsRecordHeaderLen:]); name != "" {
+					host = name
+				}
+			}
+		}
+	case isHTTPMethod(b):
+		conn.SetReadDeadline(time.Time{})
+		if err := h.Listener.Add(pconn); err != nil {
+			conn.Close()
+		}
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	addr := net.JoinHostPort(host, strconv.Itoa(dst.Port))
+	req := &http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Host: addr},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Host:       addr,
+		RemoteAddr: conn.RemoteAddr().String(),
+		RequestURI: addr,
+	}
+
+	serveConnect(pconn, req, h, func(code int) error {
+		return nil
+	})
+}
+
+func isHTTPMethod(b []byte) bool {
+	for _, m := range []string{"GET ", "POST ", "HEAD ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "TRACE "} {
+		if bytes.HasPrefix(b, []byte(m)) {
+			return true
+		}
+	}
+	return false
+}
+
+// readServerName returns the server_name extension of a TLS ClientHello.
+func readServerName(b []byte) string {
+	// handshake type(1) length(3) version(2) random(32)
+	if len(b) < 38 || b[0] != 0x01 {
+		return ""
+	}
+	b = b[38:]
+
+	// session id
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return ""
+	}
+	b = b[1+int(b[0]):]
+
+	// cipher suites
+	if len(b) < 2 {
+		return ""
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return ""
+	}
+	b = b[2+n:]
+
+	// compression methods
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return ""
+	}
+	b = b[1+int(b[0]):]
+
+	// extensions
+	if len(b) < 2 {
+		return ""
+	}
+	n = int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if len(b) > n {
+		b = b[:n]
+	}
+
+	for len(b) >= 4 {
+		typ := binary.BigEndian.Uint16(b)
+		n := int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+n {
+			return ""
+		}
+		data := b[4 : 4+n]
+		b = b[4+n:]
+
+		if typ != 0x0000 {
+			continue
+		}
+
+		// server_name_list length(2), name_type(1), host_name length(2)
+		if len(data) < 5 || data[2] != 0x00 {
+			return ""
+		}
+		m := int(binary.BigEndian.Uint16(data[3:]))
+		if len(data) < 5+m {
+			return ""
+		}
+		return string(data[5 : 5+m])
+	}
+
+	return ""
+}
+
+// peekedConn replays the bytes buffered by r before reading from Conn.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *peekedConn) unwrapRead() (net.Conn, []byte, *int64) {
+	data, _ := c.r.Peek(c.r.Buffered())
+	data = append([]byte(nil), data...)
+	c.r.Discard(len(data))
+	return c.Conn, data, nil
+}
+
+func (c *peekedConn) unwrapWrite() (net.Conn, *int64) {
+	return c.Conn, nil
+}
@@ -0,0 +1,58 @@
+package httpproxy
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soOriginalDst = 80 // SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST
+)
+
+// originalDst returns the destination of a connection before iptables REDIRECT.
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a *net.TCPConn", conn)
+	}
+
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var addr *net.TCPAddr
+	var err1 error
+	err = rc.Control(func(fd uintptr) {
+		if laddr, ok := tc.LocalAddr().(*net.TCPAddr); ok && laddr.IP.To4() == nil {
+			// struct sockaddr_in6 fits in struct ip6_mtuinfo
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+			if err != nil {
+				err1 = err
+				return
+			}
+			p := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			addr = &net.TCPAddr{IP: net.IP(info.Addr.Addr[:]), Port: int(p[0])<<8 | int(p[1])}
+			return
+		}
+
+		// struct sockaddr_in fits in struct ipv6_mreq
+		mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+		if err != nil {
+			err1 = err
+			return
+		}
+		b := mreq.Multiaddr
+		addr = &net.TCPAddr{IP: net.IPv4(b[4], b[5], b[6], b[7]), Port: int(b[2])<<8 | int(b[3])}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err1 != nil {
+		return nil, err1
+	}
+
+	return addr, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package httpproxy
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, fmt.Errorf("SO_ORIGINAL_DST is not supported on %s", runtime.GOOS)
+}
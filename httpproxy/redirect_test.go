@@ -0,0 +1,95 @@
+package httpproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+)
+
+// helloTestConn records the first write of a TLS client and fails the rest of
+// the handshake.
+type helloTestConn struct {
+	net.Conn
+	b []byte
+}
+
+func (c *helloTestConn) Write(b []byte) (int, error) {
+	if c.b == nil {
+		c.b = append([]byte(nil), b...)
+	}
+	return len(b), nil
+}
+
+func (c *helloTestConn) Read(b []byte) (int, error) {
+	return 0, errors.New("no server")
+}
+
+func (c *helloTestConn) Close() error {
+	return nil
+}
+
+// tlsClientHello returns the ClientHello of crypto/tls for serverName, without
+// the record header.
+func tlsClientHello(serverName string) []byte {
+	conn := &helloTestConn{}
+	tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	return conn.b[tlsRecordHeaderLen:]
+}
+
+// clientHello builds a ClientHello with the given session id and extensions.
+func clientHello(sessionID []byte, extensions ...[]byte) []byte {
+	b := []byte{0x01, 0, 0, 0, 0x03, 0x03}
+	b = append(b, make([]byte, 32)...)
+	b = append(b, byte(len(sessionID)))
+	b = append(b, sessionID...)
+	b = append(b, 0x00, 0x02, 0x13, 0x01, 0x01, 0x00)
+	ext := bytes.Join(extensions, nil)
+	b = append(b, byte(len(ext)>>8), byte(len(ext)))
+	return append(b, ext...)
+}
+
+func sniExtension(names ...string) []byte {
+	var list []byte
+	for _, name := range names {
+		list = append(list, 0x00, byte(len(name)>>8), byte(len(name)))
+		list = append(list, name...)
+	}
+	b := make([]byte, 6, 6+len(list))
+	binary.BigEndian.PutUint16(b[2:], uint16(2+len(list)))
+	binary.BigEndian.PutUint16(b[4:], uint16(len(list)))
+	return append(b, list...)
+}
+
+func TestReadServerName(t *testing.T) {
+	other := []byte{0x00, 0x17, 0x00, 0x00}
+	hello := clientHello([]byte{1, 2, 3}, other, sniExtension("example.com"))
+
+	tests := []struct {
+		name  string
+		hello []byte
+		host  string
+	}{
+		{"crypto/tls", tlsClientHello("www.example.com"), "www.example.com"},
+		{"crypto/tls without sni", tlsClientHello(""), ""},
+		{"after other extensions", hello, "example.com"},
+		{"first name", clientHello(nil, sniExtension("a.example.com", "b.example.com")), "a.example.com"},
+		{"no extensions", clientHello(nil), ""},
+		{"no sni", clientHello(nil, other), ""},
+		{"not a client hello", append([]byte{0x02}, hello[1:]...), ""},
+		{"truncated random", hello[:30], ""},
+		{"truncated session id", hello[:40], ""},
+		{"truncated extension", hello[:len(hello)-3], ""},
+		{"bad name type", clientHello(nil, append(sniExtension("example.com")[:6], append([]byte{0x01}, sniExtension("example.com")[7:]...)...)), ""},
+		{"name overflows", clientHello(nil, []byte{0x00, 0x00, 0x00, 0x05, 0x00, 0x03, 0x00, 0x00, 0x10}), ""},
+		{"empty", nil, ""},
+	}
+
+	for _, tt := range tests {
+		if got := readServerName(tt.hello); got != tt.host {
+			t.Errorf("%s: readServerName() = %q, want %q", tt.name, got, tt.host)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package httpproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrRelayIdleTimeout = errors.New("relay idle timeout")
+	ErrRelayTimeout     = errors.New("relay timeout")
+)
+
+// Relay copies data between two connections in both directions. When one
+// direction reaches EOF the write side of the other connection is closed, so
+// half-closed protocols keep working.
+type Relay struct {
+	// IdleTimeout closes both connections when no data flowed either way for it.
+	IdleTimeout time.Duration
+	// Timeout closes both connections when they are relayed for it.
+	Timeout time.Duration
+}
+
+// Copy relays between lconn and rconn until both directions finished. The
+// bytes are reported to the counters of the Handler wrapping lconn, which feed
+// the ConnTable, the access log and the metrics, spliced data included. Data
+// between two TCP sockets is copied by io.Copy, which splices on Linux.
+func (r *Relay) Copy(lconn, rconn net.Conn) (err error) {
+	last := time.Now().UnixNano()
+	progress := func(n int64) {
+		atomic.StoreInt64(&last, time.Now().UnixNano())
+	}
+
+	var once sync.Once
+	closeBoth := func(reason error) {
+		once.Do(func() {
+			err = reason
+			lconn.Close()
+			rconn.Close()
+		})
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	if r.Timeout > 0 {
+		timer := time.AfterFunc(r.Timeout, func() {
+			closeBoth(ErrRelayTimeout)
+		})
+		defer timer.Stop()
+	}
+
+	if r.IdleTimeout > 0 {
+		go func() {
+			ticker := time.NewTicker(r.IdleTimeout / 4)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					if time.Since(time.Unix(0, atomic.LoadInt64(&last))) >= r.IdleTimeout {
+						closeBoth(ErrRelayIdleTimeout)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	// progress of io.Copy is reported every interval for the idle check
+	interval := r.IdleTimeout / 4
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		relayHalf(rconn, lconn, progress, interval, closeBoth)
+	}()
+	relayHalf(lconn, rconn, progress, interval, closeBoth)
+	wg.Wait()
+
+	return err
+}
+
+// relayHalf copies src to dst and closes the write side of dst at EOF, both
+// connections are closed on errors or if dst can not be half-closed.
+func relayHalf(dst, src net.Conn, progress func(int64), interval time.Duration, closeBoth func(error)) {
+	if err := relayCopy(dst, src, progress, interval); err != nil {
+		closeBoth(err)
+		return
+	}
+	if !closeWrite(dst) {
+		closeBoth(nil)
+	}
+}
+
+func relayCopy(dst, src net.Conn, progress func(int64), interval time.Duration) error {
+	dsock, dcounters := unwrapWrite(dst)
+	if dsock != nil {
+		ssock, data, scounters := unwrapRead(src)
+		if len(data) > 0 {
+			n, err := dst.Write(data)
+			progress(int64(n))
+			if err != nil {
+				return err
+			}
+		}
+		if ssock != nil {
+			return tcpCopy(dsock, ssock, interval, func(n int64) {
+				for _, c := range scounters {
+					atomic.AddInt64(c, n)
+				}
+				for _, c := range dcounters {
+					atomic.AddInt64(c, n)
+				}
+				progress(n)
+			})
+		}
+	}
+
+	buf := bufpool.Get().([]byte)
+	defer bufpool.Put(buf)
+	for {
+		nr, er := src.Read(buf)
+		if nr > 0 {
+			nw, ew := dst.Write(buf[:nr])
+			progress(int64(nw))
+			if ew != nil {
+				return ew
+			}
+			if nr != nw {
+				return io.ErrShortWrite
+			}
+		}
+		if er == io.EOF {
+			return nil
+		}
+		if er != nil {
+			return er
+		}
+	}
+}
+
+// tcpCopy copies src to dst with io.Copy, if interval is positive the copy is
+// interrupted by read deadlines to report progress every interval.
+func tcpCopy(dst, src *net.TCPConn, interval time.Duration, progress func(int64)) error {
+	if interval <= 0 {
+		n, err := io.Copy(dst, src)
+		progress(n)
+		return err
+	}
+
+	defer src.SetReadDeadline(time.Time{})
+	for {
+		src.SetReadDeadline(time.Now().Add(interval))
+		n, err := io.Copy(dst, src)
+		if n > 0 {
+			progress(n)
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			return err
+		}
+	}
+}
+
+// closeWrite half-closes c, it reports false if c does not support it.
+func closeWrite(c net.Conn) bool {
+	for c != nil {
+		if cw, ok := c.(interface {
+			CloseWrite() error
+		}); ok {
+			cw.CloseWrite()
+			return true
+		}
+		w, ok := c.(relayWrapper)
+		if !ok {
+			return false
+		}
+		c, _ = w.unwrapWrite()
+	}
+	return false
+}
+
+// relayWrapper is implemented by net.Conn wrappers which Relay looks through
+// to splice the underlying sockets.
+type relayWrapper interface {
+	// unwrapRead returns the wrapped conn, or nil if it can not be read
+	// directly, along with the data read ahead which is consumed and the
+	// counter of bytes read.
+	unwrapRead() (net.Conn, []byte, *int64)
+	// unwrapWrite returns the wrapped conn, or nil if it can not be written
+	// directly, along with the counter of bytes written.
+	unwrapWrite() (net.Conn, *int64)
+}
+
+func unwrapRead(c net.Conn) (*net.TCPConn, []byte, []*int64) {
+	var buffered []byte
+	var counters []*int64
+	for {
+		switch v := c.(type) {
+		case *net.TCPConn:
+			return v, buffered, counters
+		case relayWrapper:
+			conn, data, counter := v.unwrapRead()
+			buffered = append(buffered, data...)
+			if counter != nil {
+				counters = append(counters, counter)
+			}
+			if conn == nil {
+				return nil, buffered, nil
+			}
+			c = conn
+		default:
+			return nil, buffered, nil
+		}
+	}
+}
+
+func unwrapWrite(c net.Conn) (*net.TCPConn, []*int64) {
+	var counters []*int64
+	for {
+		switch v := c.(type) {
+		case *net.TCPConn:
+			return v, counters
+		case relayWrapper:
+			conn, counter := v.unwrapWrite()
+			if conn == nil {
+				return nil, nil
+			}
+			if counter != nil {
+				counters = append(counters, counter)
+			}
+			c = conn
+		default:
+			return nil, nil
+		}
+	}
+}
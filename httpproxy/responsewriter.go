@@ -0,0 +1,138 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// serveConnect serves a synthetic CONNECT request of a raw client conn with h,
+// reply is called once with the response status given by filters.
+func serveConnect(conn net.Conn, req *http.Request, h http.Handler, reply func(code int) error) {
+	rw := &connectResponseWriter{
+		conn:   conn,
+		header: http.Header{},
+		reply:  reply,
+	}
+
+	h.ServeHTTP(rw, req)
+
+	rw.mu.Lock()
+	hijacked := rw.hijacked
+	rw.mu.Unlock()
+
+	if !hijacked {
+		rw.WriteHeader(http.StatusBadGateway)
+		conn.Close()
+	}
+}
+
+// connectResponseWriter translates the CONNECT response of filters to the
+// reply of the client protocol, non 2xx responses fail the request.
+type connectResponseWriter struct {
+	conn     net.Conn
+	header   http.Header
+	reply    func(code int) error
+	mu       sync.Mutex
+	replied  bool
+	failed   bool
+	hijacked bool
+}
+
+func (rw *connectResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *connectResponseWriter) WriteHeader(code int) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.writeReply(code)
+}
+
+func (rw *connectResponseWriter) writeReply(code int) {
+	if rw.replied {
+		return
+	}
+	rw.replied = true
+
+	if err := rw.reply(code); err != nil || code < 200 || code >= 300 {
+		rw.failed = true
+	}
+}
+
+func (rw *connectResponseWriter) Write(b []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.writeReply(http.StatusOK)
+	if rw.failed {
+		return len(b), nil
+	}
+	return rw.conn.Write(b)
+}
+
+func (rw *connectResponseWriter) Flush() {
+}
+
+func (rw *connectResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if rw.hijacked {
+		return nil, nil, http.ErrHijacked
+	}
+	if rw.failed {
+		return nil, nil, fmt.Errorf("CONNECT request from %s already failed", rw.conn.RemoteAddr())
+	}
+	rw.hijacked = true
+
+	conn := &connectConn{Conn: rw.conn, rw: rw}
+	return conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
+}
+
+// connectConn converts a "HTTP/1.1 200 OK\r\n\r\n" written by filters after
+// hijacking to the reply of the client protocol.
+type connectConn struct {
+	net.Conn
+	rw *connectResponseWriter
+}
+
+func (c *connectConn) Write(b []byte) (int, error) {
+	c.rw.mu.Lock()
+	if !c.rw.replied {
+		n := 0
+		code := http.StatusOK
+		if bytes.HasPrefix(b, []byte("HTTP/1.")) {
+			if i := bytes.Index(b, []byte("\r\n\r\n")); i > 0 {
+				n = i + 4
+				if resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b[:n])), nil); err == nil {
+					code = resp.StatusCode
+				}
+			}
+		}
+		c.rw.writeReply(code)
+		c.rw.mu.Unlock()
+		if n == len(b) {
+			return n, nil
+		}
+		m, err := c.Conn.Write(b[n:])
+		return n + m, err
+	}
+	c.rw.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *connectConn) unwrapRead() (net.Conn, []byte, *int64) {
+	return c.Conn, nil, nil
+}
+
+func (c *connectConn) unwrapWrite() (net.Conn, *int64) {
+	c.rw.mu.Lock()
+	defer c.rw.mu.Unlock()
+	if !c.rw.replied {
+		return nil, nil
+	}
+	return c.Conn, nil
+}
@@ -0,0 +1,110 @@
+package httpproxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// RotateFile is an append only file which is renamed to Filename.1 ...
+// Filename.MaxBackups once it grows over MaxSize.
+type RotateFile struct {
+	Filename   string
+	MaxSize    int64
+	MaxBackups int
+	mu         sync.Mutex
+	file       *os.File
+	size       int64
+}
+
+func OpenRotateFile(filename string, maxSize int64, maxBackups int) (*RotateFile, error) {
+	if dirname := filepath.Dir(filename); dirname != "" {
+		if err := os.MkdirAll(dirname, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	f := &RotateFile{
+		Filename:   filename,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+	}
+
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *RotateFile) open() error {
+	file, err := os.OpenFile(f.Filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = fi.Size()
+	return nil
+}
+
+func (f *RotateFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+
+	var err error
+	if f.MaxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", f.Filename, f.MaxBackups))
+		for i := f.MaxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.Filename, i), fmt.Sprintf("%s.%d", f.Filename, i+1))
+		}
+		err = os.Rename(f.Filename, f.Filename+".1")
+	} else {
+		err = os.Remove(f.Filename)
+	}
+
+	// keep writing to the old file if it could not be moved away
+	if err1 := f.open(); err1 != nil {
+		return err1
+	}
+	return err
+}
+
+func (f *RotateFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.MaxSize > 0 && f.size+int64(len(b)) > f.MaxSize && f.size > 0 {
+		if err := f.rotate(); err != nil {
+			glog.Warningf("%T.rotate(%#v) error: %v", f, f.Filename, err)
+		}
+	}
+
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotateFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
@@ -0,0 +1,127 @@
+package httpproxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"./filters"
+)
+
+type Rule struct {
+	Name    string
+	Hosts   *HostMatcher
+	Ports   map[string]struct{}
+	Methods map[string]struct{}
+	Paths   []string
+	Sources []*net.IPNet
+	Users   map[string]struct{}
+	Filter  filters.RoundTripFilter
+	// Middlewares wrap Filter and ResponseFilters run on its response, before
+	// the ones of the chain
+	Middlewares     []filters.MiddlewareFilter
+	ResponseFilters []filters.ResponseFilter
+}
+
+// Match reports whether req matches all non-empty conditions of the rule.
+func (r *Rule) Match(ctx *filters.Context, req *http.Request) bool {
+	host, port := req.Host, ""
+	if h, p, err := net.SplitHostPort(req.Host); err == nil {
+		host, port = h, p
+	}
+	if port == "" {
+		switch {
+		case req.Method == "CONNECT", req.URL.Scheme == "https":
+			port = "443"
+		default:
+			port = "80"
+		}
+	}
+
+	if r.Hosts != nil && !r.Hosts.Match(host) {
+		return false
+	}
+
+	if len(r.Ports) > 0 {
+		if _, ok := r.Ports[port]; !ok {
+			return false
+		}
+	}
+
+	if len(r.Methods) > 0 {
+		if _, ok := r.Methods[req.Method]; !ok {
+			return false
+		}
+	}
+
+	if len(r.Paths) > 0 {
+		matched := false
+		for _, prefix := range r.Paths {
+			if strings.HasPrefix(req.URL.Path, prefix) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(r.Sources) > 0 {
+		ip, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			return false
+		}
+		ip1 := net.ParseIP(ip)
+		matched := false
+		for _, ipnet := range r.Sources {
+			if ip1 != nil && ipnet.Contains(ip1) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(r.Users) > 0 {
+		if _, ok := r.Users[ctx.GetUsername()]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Router dispatches requests to the RoundTripFilter of the first matching rule.
+type Router struct {
+	Rules   []*Rule
+	targets map[filters.RoundTripFilter]struct{}
+}
+
+func NewRouter(rules []*Rule) *Router {
+	r := &Router{
+		Rules:   rules,
+		targets: make(map[filters.RoundTripFilter]struct{}),
+	}
+	for _, rule := range rules {
+		r.targets[rule.Filter] = struct{}{}
+	}
+	return r
+}
+
+// IsTarget reports whether f is the target filter of some rule.
+func (r *Router) IsTarget(f filters.RoundTripFilter) bool {
+	_, ok := r.targets[f]
+	return ok
+}
+
+func (r *Router) Route(ctx *filters.Context, req *http.Request) *Rule {
+	for _, rule := range r.Rules {
+		if rule.Match(ctx, req) {
+			return rule
+		}
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package httpproxy
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	socksVersion5 byte = 0x05
+
+	socksAuthNone         byte = 0x00
+	socksAuthPassword     byte = 0x02
+	socksAuthNoAcceptable byte = 0xff
+
+	socksCmdConnect byte = 0x01
+
+	socksAtypIPv4   byte = 0x01
+	socksAtypDomain byte = 0x03
+	socksAtypIPv6   byte = 0x04
+
+	socksRepSucceeded           byte = 0x00
+	socksRepGeneralFailure      byte = 0x01
+	socksRepNotAllowed          byte = 0x02
+	socksRepHostUnreachable     byte = 0x04
+	socksRepCommandNotSupported byte = 0x07
+
+	socksHandshakeTimeout = 30 * time.Second
+)
+
+// CredentialFilter is implemented by filters checking client credentials, the
+// SOCKS5 listener asks them before it accepts a username and password.
+type CredentialFilter interface {
+	CheckCredential(remoteAddr, username, password string) bool
+}
+
+// ServeSocks accepts SOCKS5 connections on ln, every CONNECT command is served
+// by h as a synthetic HTTP CONNECT request.
+func ServeSocks(ln net.Listener, h http.Handler) error {
+	var tempDelay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				glog.Infof("httpproxy.ServeSocks: Accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+		go serveSocks(conn, h)
+	}
+}
+
+func serveSocks(conn net.Conn, h http.Handler) {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+
+	check := func(username, password string) bool {
+		return true
+	}
+	if h1, ok := h.(*Handler); ok {
+		check = func(username, password string) bool {
+			return h1.CheckCredential(conn.RemoteAddr().String(), username, password)
+		}
+	}
+
+	req, err := readSocksRequest(conn, check)
+	if err != nil {
+		glog.V(2).Infof("%s readSocksRequest error: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	serveConnect(conn, req, h, func(code int) error {
+		return writeSocksReply(conn, socksReplyCode(code))
+	})
+}
+
+// readSocksRequest reads the SOCKS5 handshake and converts the CONNECT
+// command to a http.Request, the credential is checked by check and passed as
+// Proxy-Authorization.
+func readSocksRequest(conn net.Conn, check func(username, password string) bool) (*http.Request, error) {
+	var b [255]byte
+
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return nil, err
+	}
+	if b[0] != socksVersion5 {
+		return nil, fmt.Errorf("unsupported socks version %d", b[0])
+	}
+
+	methods := make([]byte, int(b[1]))
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+
+	method := socksAuthNoAcceptable
+	for _, m := range methods {
+		if m == socksAuthPassword {
+			method = m
+			break
+		}
+		if m == socksAuthNone {
+			method = m
+		}
+	}
+
+	if _, err := conn.Write([]byte{socksVersion5, method}); err != nil {
+		return nil, err
+	}
+
+	var username, password string
+	switch method {
+	case socksAuthNoAcceptable:
+		return nil, fmt.Errorf("no acceptable socks auth methods %v", methods)
+	case socksAuthPassword:
+		if _, err := io.ReadFull(conn, b[:2]); err != nil {
+			return nil, err
+		}
+		user := make([]byte, int(b[1]))
+		if _, err := io.ReadFull(conn, user); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, b[:1]); err != nil {
+			return nil, err
+		}
+		pass := make([]byte, int(b[0]))
+		if _, err := io.ReadFull(conn, pass); err != nil {
+			return nil, err
+		}
+		username, password = string(user), string(pass)
+		if !check(username, password) {
+			conn.Write([]byte{0x01, 0x01})
+			return nil, fmt.Errorf("socks user %#v authentication failed", username)
+		}
+		if _, err := conn.Write([]byte{0x01, 0x00}); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := io.ReadFull(conn, b[:4]); err != nil {
+		return nil, err
+	}
+	if b[0] != socksVersion5 {
+		return nil, fmt.Errorf("unsupported socks version %d", b[0])
+	}
+	if b[1] != socksCmdConnect {
+		writeSocksReply(conn, socksRepCommandNotSupported)
+		return nil, fmt.Errorf("unsupported socks command %d", b[1])
+	}
+
+	var host string
+	switch b[3] {
+	case socksAtypIPv4:
+		if _, err := io.ReadFull(conn, b[:net.IPv4len]); err != nil {
+			return nil, err
+		}
+		host = net.IP(b[:net.IPv4len]).String()
+	case socksAtypIPv6:
+		if _, err := io.ReadFull(conn, b[:net.IPv6len]); err != nil {
+			return nil, err
+		}
+		host = net.IP(b[:net.IPv6len]).String()
+	case socksAtypDomain:
+		if _, err := io.ReadFull(conn, b[:1]); err != nil {
+			return nil, err
+		}
+		n := int(b[0])
+		if _, err := io.ReadFull(conn, b[:n]); err != nil {
+			return nil, err
+		}
+		host = string(b[:n])
+	default:
+		return nil, fmt.Errorf("unsupported socks address type %d", b[3])
+	}
+
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(b[:2]))))
+
+	req := &http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Host: addr},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Host:       addr,
+		RemoteAddr: conn.RemoteAddr().String(),
+		RequestURI: addr,
+	}
+
+	if username != "" {
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":"+password)))
+	}
+
+	return req, nil
+}
+
+func writeSocksReply(w io.Writer, rep byte) error {
+	_, err := w.Write([]byte{socksVersion5, rep, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func socksReplyCode(code int) byte {
+	switch {
+	case code >= 200 && code < 300:
+		return socksRepSucceeded
+	case code == http.StatusForbidden, code == http.StatusProxyAuthRequired:
+		return socksRepNotAllowed
+	case code == http.StatusNotFound:
+		return socksRepHostUnreachable
+	default:
+		return socksRepGeneralFailure
+	}
+}
@@ -0,0 +1,95 @@
+package httpproxy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// socksTestConn reads the client side of a handshake and records the replies.
+type socksTestConn struct {
+	net.Conn
+	r *bytes.Reader
+	w bytes.Buffer
+}
+
+func (c *socksTestConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *socksTestConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func (c *socksTestConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}
+}
+
+func socksConcat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestReadSocksRequest(t *testing.T) {
+	noAuth := []byte{0x05, 0x01, 0x00}
+	passAuth := []byte{0x05, 0x02, 0x00, 0x02}
+	goodUser := []byte{0x01, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's'}
+	badUser := []byte{0x01, 4, 'u', 's', 'e', 'r', 4, 'b', 'a', 'd', '!'}
+	ipv4 := []byte{0x05, 0x01, 0x00, 0x01, 10, 0, 0, 1, 0x01, 0xbb}
+	ipv6 := socksConcat([]byte{0x05, 0x01, 0x00, 0x04}, net.ParseIP("2001:db8::1"), []byte{0x00, 0x50})
+	domain := socksConcat([]byte{0x05, 0x01, 0x00, 0x03, 11}, []byte("example.com"), []byte{0x00, 0x50})
+
+	tests := []struct {
+		name  string
+		input []byte
+		host  string
+		auth  string
+		reply []byte
+		err   bool
+	}{
+		{"ipv4", socksConcat(noAuth, ipv4), "10.0.0.1:443", "", []byte{0x05, 0x00}, false},
+		{"ipv6", socksConcat(noAuth, ipv6), "[2001:db8::1]:80", "", []byte{0x05, 0x00}, false},
+		{"domain", socksConcat(noAuth, domain), "example.com:80", "", []byte{0x05, 0x00}, false},
+		{"password", socksConcat(passAuth, goodUser, domain), "example.com:80", "Basic dXNlcjpwYXNz", []byte{0x05, 0x02, 0x01, 0x00}, false},
+		{"wrong password", socksConcat(passAuth, badUser, domain), "", "", []byte{0x05, 0x02, 0x01, 0x01}, true},
+		{"no acceptable method", []byte{0x05, 0x01, 0x01}, "", "", []byte{0x05, 0xff}, true},
+		{"socks4", []byte{0x04, 0x01, 0x00, 0x50}, "", "", nil, true},
+		{"bind", socksConcat(noAuth, []byte{0x05, 0x02, 0x00, 0x01, 10, 0, 0, 1, 0x01, 0xbb}), "", "", []byte{0x05, 0x00, 0x05, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0, 0}, true},
+		{"bad address type", socksConcat(noAuth, []byte{0x05, 0x01, 0x00, 0x02, 10, 0, 0, 1, 0x01, 0xbb}), "", "", []byte{0x05, 0x00}, true},
+		{"truncated methods", []byte{0x05, 0x02, 0x00}, "", "", nil, true},
+		{"truncated credential", socksConcat(passAuth, goodUser[:5]), "", "", []byte{0x05, 0x02}, true},
+		{"truncated address", socksConcat(noAuth, ipv4[:6]), "", "", []byte{0x05, 0x00}, true},
+		{"truncated port", socksConcat(noAuth, domain[:len(domain)-1]), "", "", []byte{0x05, 0x00}, true},
+		{"empty", nil, "", "", nil, true},
+	}
+
+	check := func(username, password string) bool {
+		return username == "user" && password == "pass"
+	}
+
+	for _, tt := range tests {
+		conn := &socksTestConn{r: bytes.NewReader(tt.input)}
+		req, err := readSocksRequest(conn, check)
+		if !bytes.Equal(conn.w.Bytes(), tt.reply) {
+			t.Errorf("%s: replies = %v, want %v", tt.name, conn.w.Bytes(), tt.reply)
+		}
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: readSocksRequest() returned no error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: readSocksRequest() error: %v", tt.name, err)
+			continue
+		}
+		if req.Method != "CONNECT" || req.Host != tt.host || req.URL.Host != tt.host {
+			t.Errorf("%s: request = %s %s (%s), want CONNECT %s", tt.name, req.Method, req.Host, req.URL.Host, tt.host)
+		}
+		if got := req.Header.Get("Proxy-Authorization"); got != tt.auth {
+			t.Errorf("%s: Proxy-Authorization = %q, want %q", tt.name, got, tt.auth)
+		}
+		if req.RemoteAddr != "127.0.0.1:12345" {
+			t.Errorf("%s: RemoteAddr = %q", tt.name, req.RemoteAddr)
+		}
+	}
+}
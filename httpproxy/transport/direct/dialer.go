@@ -1,6 +1,7 @@
 package direct
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"sync"
@@ -8,8 +9,12 @@ import (
 
 	"github.com/cloudflare/golibs/lrucache"
 	"github.com/golang/glog"
+
+	"../../metrics"
 )
 
+var dnsCacheLookups = metrics.NewCounter("goproxy_direct_dns_cache_lookups_total", "DNS cache lookups of direct dialers, by result.", "result")
+
 const (
 	DefaultRetryTimes      int           = 2
 	DefaultRetryDelay      time.Duration = 100 * time.Millisecond
@@ -66,7 +71,19 @@ func (d *Dialer) init() {
 	})
 }
 
-func (d *Dialer) Dial(network, address string) (conn net.Conn, err error) {
+// ClearDNSCache drops the cached DNS records and returns their number.
+func (d *Dialer) ClearDNSCache() int {
+	d.init()
+	return d.dnsCache.Clear()
+}
+
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext is Dial which gives up the lookup, the dials and the retries
+// once ctx is done.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
 	d.init()
 
 	glog.V(3).Infof("Dail(%#v, %#v)", network, address)
@@ -74,11 +91,13 @@ func (d *Dialer) Dial(network, address string) (conn net.Conn, err error) {
 	switch network {
 	case "tcp", "tcp4", "tcp6":
 		if addr, ok := d.dnsCache.Get(address); ok {
+			dnsCacheLookups.Inc("hit")
 			address = addr.(string)
 		} else {
+			dnsCacheLookups.Inc("miss")
 			if host, port, err := net.SplitHostPort(address); err == nil {
-				if ips, err := net.LookupIP(host); err == nil && len(ips) > 0 {
-					ip := ips[0].String()
+				if ips, err := net.DefaultResolver.LookupIPAddr(ctx, host); err == nil && len(ips) > 0 {
+					ip := ips[0].IP.String()
 					if d.loAddrs != nil {
 						if _, ok := d.loAddrs[ip]; ok {
 							return nil, net.InvalidAddrError(fmt.Sprintf("Invaid DNS Record: %s(%s)", host, ip))
@@ -97,11 +116,15 @@ func (d *Dialer) Dial(network, address string) (conn net.Conn, err error) {
 
 	if d.DialConcurrentNumber <= 1 {
 		for i := 0; i < d.RetryTimes; i++ {
-			conn, err = d.Dialer.Dial(network, address)
+			conn, err = d.Dialer.DialContext(ctx, network, address)
 			if err == nil || i == d.RetryTimes-1 {
 				break
 			}
-			time.Sleep(d.RetryDelay)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(d.RetryDelay):
+			}
 		}
 		return conn, err
 	} else {
@@ -115,7 +138,7 @@ func (d *Dialer) Dial(network, address string) (conn net.Conn, err error) {
 		for i := 0; i < retry; i++ {
 			for j := 0; j < d.DialConcurrentNumber; j++ {
 				go func(addr string, c chan<- racer) {
-					conn, err := d.Dialer.Dial(network, addr)
+					conn, err := d.Dialer.DialContext(ctx, network, addr)
 					lane <- racer{conn, err}
 				}(address, lane)
 			}
@@ -56,7 +56,7 @@ func (f *Server) encodeRequest(req *http.Request) (*http.Request, error) {
 		req1.Body = transport.NewMultiReadCloser(bytes.NewReader(b0), &b)
 	}
 
-	return req1, nil
+	return req1.WithContext(req.Context()), nil
 }
 
 func (f *Server) decodeResponse(resp *http.Response) (resp1 *http.Response, err error) {
@@ -73,7 +73,7 @@ func (s *Server) encodeRequest(req *http.Request) (*http.Request, error) {
 		req1.Body = httpproxy.NewMultiReadCloser(bytes.NewReader(b0), &b)
 	}
 
-	return req1, nil
+	return req1.WithContext(req.Context()), nil
 }
 
 func (s *Server) decodeResponse(resp *http.Response) (resp1 *http.Response, err error) {
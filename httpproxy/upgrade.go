@@ -0,0 +1,133 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// IsUpgrade reports whether req asks to switch protocols, e.g. WebSocket.
+func IsUpgrade(req *http.Request) bool {
+	if req.ProtoMajor != 1 || req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range req.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// UpgradeAddr returns the host:port of the origin of the upgrade request req.
+func UpgradeAddr(req *http.Request) string {
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(req.URL.Hostname(), port)
+}
+
+// DialUpgrade connects to the origin of the upgrade request req with dial,
+// over TLS with a copy of config if req is https.
+func DialUpgrade(req *http.Request, dial func(ctx context.Context, network, addr string) (net.Conn, error), config *tls.Config) (net.Conn, error) {
+	conn, err := dial(req.Context(), "tcp", UpgradeAddr(req))
+	if err != nil || req.URL.Scheme != "https" {
+		return conn, err
+	}
+
+	config = config.Clone()
+	config.ServerName = req.URL.Hostname()
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(req.Context()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// Upgrade sends the upgrade request req over rconn. If the origin switches
+// protocols, the 101 response is written to rw and both connections are
+// relayed by relay until they are done, the returned response is nil.
+// Otherwise the origin response is returned and rconn is closed along with
+// its body.
+func Upgrade(rw http.ResponseWriter, req *http.Request, rconn net.Conn, relay *Relay) (*http.Response, error) {
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		rconn.Close()
+		return nil, fmt.Errorf("http.ResponseWriter(%#v) does not implments http.Hijacker", rw)
+	}
+
+	req1 := new(http.Request)
+	*req1 = *req
+	req1.Header = make(http.Header)
+	for key, values := range req.Header {
+		switch key {
+		case "Proxy-Connection", "Proxy-Authorization", "Keep-Alive":
+			continue
+		}
+		req1.Header[key] = values
+	}
+	req1.Header.Set("Connection", "Upgrade")
+	req1.Body = nil
+	req1.ContentLength = 0
+
+	if err := req1.Write(rconn); err != nil {
+		rconn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(rconn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		rconn.Close()
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body = &connBody{resp.Body, rconn}
+		return resp, nil
+	}
+
+	lconn, brw, err := hijacker.Hijack()
+	if err != nil {
+		rconn.Close()
+		return nil, fmt.Errorf("%#v.Hijack() error: %v", hijacker, err)
+	}
+	defer lconn.Close()
+	defer rconn.Close()
+
+	if err := resp.Write(lconn); err != nil {
+		return nil, nil
+	}
+
+	if brw != nil {
+		lconn = &peekedConn{Conn: lconn, r: brw.Reader}
+	}
+
+	relay.Copy(lconn, &peekedConn{Conn: rconn, r: br})
+
+	return nil, nil
+}
+
+// connBody closes the connection along with the response body.
+type connBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b *connBody) Close() error {
+	b.ReadCloser.Close()
+	return b.conn.Close()
+}
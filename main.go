@@ -1,17 +1,21 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
@@ -24,41 +28,145 @@ import (
 
 	_ "./httpproxy/filters/auth"
 	_ "./httpproxy/filters/autoproxy"
+	_ "./httpproxy/filters/cache"
 	_ "./httpproxy/filters/direct"
 	_ "./httpproxy/filters/gae"
 	_ "./httpproxy/filters/iplist"
+	_ "./httpproxy/filters/peercache"
 	_ "./httpproxy/filters/php"
 	_ "./httpproxy/filters/ratelimit"
 	_ "./httpproxy/filters/stripssl"
+	_ "./httpproxy/filters/upstream"
 	_ "./httpproxy/filters/vps"
 )
 
 var version = "r9999"
 
+const (
+	defaultGracefulTimeout = 5 * time.Minute
+)
+
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
+type FiltersConfig struct {
+	Request    []string
+	Middleware []string
+	RoundTrip  []string
+	Response   []string
+	Routes     []struct {
+		Name       string
+		Hosts      []string
+		Ports      []int
+		Methods    []string
+		Paths      []string
+		Sources    []string
+		Users      []string
+		Filter     string
+		Middleware []string
+		Response   []string
+	}
+	Failover struct {
+		Enabled     bool
+		StatusCodes []int
+		MaxBodySize int64
+	}
+	// Timeouts are the deadlines in seconds of RoundTrip filters by name, each
+	// covers the whole request including the response body
+	Timeouts map[string]int
+}
+
+type ListenerConfig struct {
+	Name           string
+	Network        string
+	Addr           string
+	Ssl            bool
+	Certificate    string
+	PrivateKey     string
+	ProxyProtocol  bool
+	TrustedProxies []string
+	// Mode is the octal permissions of unix socket files, e.g. "0660"
+	Mode    string
+	Filters FiltersConfig
+}
+
 type Config struct {
-	LogToStderr bool
-	Addr        string
-	Http        struct {
+	LogToStderr     bool
+	Addr            string
+	GracefulTimeout int
+	Http            struct {
 		Ssl             bool
 		KeepAlivePeriod int
 		ReadTimeout     int
 		WriteTimeout    int
 		Certificate     string
 		PrivateKey      string
+		ProxyProtocol   bool
+		TrustedProxies  []string
 	}
+	Listeners  []ListenerConfig
 	GroupCache struct {
 		Addr  string
 		Peers []string
 	}
-	Filters struct {
-		Request   []string
-		RoundTrip []string
-		Response  []string
+	Socks struct {
+		Addr     string
+		Listener string
+	}
+	Redirect struct {
+		Addr     string
+		Listener string
+	}
+	Admin struct {
+		Addr     string
+		Username string
+		Password string
+	}
+	AccessLog struct {
+		Filename   string
+		Format     string
+		MaxSize    int64
+		MaxBackups int
+	}
+	Filters FiltersConfig
+}
+
+// listeners returns config.Listeners, or a listener named "default" of the
+// top level Addr, Http and Filters if there is none.
+func (config *Config) listeners() ([]ListenerConfig, error) {
+	if len(config.Listeners) == 0 {
+		return []ListenerConfig{{
+			Name:           "default",
+			Network:        "tcp",
+			Addr:           config.Addr,
+			Ssl:            config.Http.Ssl,
+			Certificate:    config.Http.Certificate,
+			PrivateKey:     config.Http.PrivateKey,
+			ProxyProtocol:  config.Http.ProxyProtocol,
+			TrustedProxies: config.Http.TrustedProxies,
+			Filters:        config.Filters,
+		}}, nil
+	}
+
+	names := make(map[string]struct{})
+	for i, lc := range config.Listeners {
+		if lc.Name == "" || strings.ContainsAny(lc.Name, ",=") {
+			return nil, fmt.Errorf("listener %d has invalid name %#v", i, lc.Name)
+		}
+		if _, ok := names[lc.Name]; ok {
+			return nil, fmt.Errorf("listener name %#v is duplicated", lc.Name)
+		}
+		names[lc.Name] = struct{}{}
 	}
+	return config.Listeners, nil
+}
+
+// server is a listener serving with its own handler and filter chain.
+type server struct {
+	ln httpproxy.Listener
+	h  *httpproxy.Handler
+	s  *http.Server
 }
 
 func main() {
@@ -76,6 +184,9 @@ func main() {
 	flag.StringVar(&pidfile, "pidfile", "", "goproxy pidfile")
 	flag.StringVar(&config.Addr, "addr", config.Addr, "goproxy listen address")
 	flag.StringVar(&config.GroupCache.Addr, "groupcache-addr", config.GroupCache.Addr, "groupcache listen address")
+	flag.StringVar(&config.Socks.Addr, "socks-addr", config.Socks.Addr, "socks5 listen address")
+	flag.StringVar(&config.Redirect.Addr, "redirect-addr", config.Redirect.Addr, "iptables redirect listen address")
+	flag.StringVar(&config.Admin.Addr, "admin-addr", config.Admin.Addr, "admin listen address")
 	if config.LogToStderr || runtime.GOOS == "windows" {
 		logToStderr := true
 		for i := 1; i < len(os.Args); i++ {
@@ -96,142 +207,572 @@ func main() {
 		}
 	}
 
+	inherited := inheritedFiles()
+
 	var ln0 net.Listener
 	if config.GroupCache.Addr != "" {
 		peers := groupcache.NewHTTPPool("http://" + config.GroupCache.Addr)
 		peers.Set(config.GroupCache.Peers...)
-		ln0, err = net.Listen("tcp", config.GroupCache.Addr)
+		if f, ok := inherited["groupcache"]; ok {
+			ln0, err = net.FileListener(f)
+			f.Close()
+		} else {
+			ln0, err = net.Listen("tcp", config.GroupCache.Addr)
+		}
 		if err != nil {
 			glog.Fatalf("ListenTCP(%s) error: %s", config.GroupCache.Addr, err)
 		}
 		go http.Serve(ln0, peers)
 	}
 
+	lcs, err := config.listeners()
+	if err != nil {
+		glog.Fatalf("Listeners error: %s", err)
+	}
+
 	fmt.Fprintf(os.Stderr, `------------------------------------------------------
 GoProxy Version    : %s (go/%s %s/%s)
-Listen Address     : %s
+`, version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	for _, lc := range lcs {
+		fmt.Fprintf(os.Stderr, `Listen Address     : %s (%s)
 RoundTrip Filters  : %v
-Pac Server         : http://%s/proxy.pac
-------------------------------------------------------
-`, version, runtime.Version(), runtime.GOOS, runtime.GOARCH,
-		config.Addr,
-		fmt.Sprintf("%s|%s|%s", strings.Join(config.Filters.Request, ","), strings.Join(config.Filters.RoundTrip, ","), strings.Join(config.Filters.Response, ",")),
-		config.Addr)
+`, lc.Addr, lc.Name,
+			fmt.Sprintf("%s|%s|%s", strings.Join(lc.Filters.Request, ","), strings.Join(lc.Filters.RoundTrip, ","), strings.Join(lc.Filters.Response, ",")))
+		if lc.Network != "unix" {
+			fmt.Fprintf(os.Stderr, "Pac Server         : http://%s/proxy.pac\n", lc.Addr)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "------------------------------------------------------\n")
+
+	var accessLogOutput io.Writer
+	if config.AccessLog.Filename != "" {
+		f, err := httpproxy.OpenRotateFile(config.AccessLog.Filename, config.AccessLog.MaxSize, config.AccessLog.MaxBackups)
+		if err != nil {
+			glog.Fatalf("OpenRotateFile(%#v) error: %s", config.AccessLog.Filename, err)
+		}
+		defer f.Close()
+		accessLogOutput = f
+	}
+	accessLog, err := httpproxy.NewAccessLog(config.AccessLog.Format, accessLogOutput)
+	if err != nil {
+		glog.Fatalf("NewAccessLog(%#v) error: %s", config.AccessLog.Format, err)
+	}
 
-	requestFilters, roundtripFilters, responseFilters := getFilters(config)
+	filtersCtx, stopFilters := context.WithCancel(context.Background())
+	defer stopFilters()
 
-	var tlsConfig *tls.Config
-	if config.Http.Ssl {
+	conns := httpproxy.NewConnTable()
+	servers := make([]*server, 0, len(lcs))
+	handlers := make([]*httpproxy.Handler, 0, len(lcs))
+	for _, lc := range lcs {
+		chain, err := getFilters(&lc.Filters)
+		if err != nil {
+			glog.Fatalf("getFilters(%#v) of listener %#v error: %s", lc.Filters, lc.Name, err)
+		}
 
-		readPem := func(object string) []byte {
-			store, err := storage.OpenURI(configUri)
+		listenOpts := &httpproxy.ListenOptions{
+			ProxyProtocol: lc.ProxyProtocol,
+		}
+		if lc.Mode != "" {
+			mode, err := strconv.ParseUint(lc.Mode, 8, 32)
 			if err != nil {
-				glog.Fatalf("store.OpenURI(%v) error: %s", configUri, err)
+				glog.Fatalf("Mode %#v of listener %#v error: %s", lc.Mode, lc.Name, err)
 			}
-
-			o, err := store.GetObject(object, -1, -1)
+			listenOpts.Mode = os.FileMode(mode)
+		}
+		if lc.Ssl {
+			listenOpts.TLSConfig = readTLSConfig(configUri, lc.Certificate, lc.PrivateKey)
+		}
+		for _, source := range lc.TrustedProxies {
+			ipnet, err := parseIPNet(source)
 			if err != nil {
-				glog.Fatalf("store.GetObject(%v) error: %s", object, err)
+				glog.Fatalf("TrustedProxies %#v of listener %#v error: %s", source, lc.Name, err)
 			}
+			listenOpts.TrustedProxies = append(listenOpts.TrustedProxies, ipnet)
+		}
+		if lc.ProxyProtocol && len(listenOpts.TrustedProxies) == 0 {
+			glog.Fatalf("ProxyProtocol of listener %#v requires TrustedProxies", lc.Name)
+		}
+
+		f, ok := inherited["addr:"+lc.Name]
+		if !ok && lc.Name == "default" {
+			// binaries before named listeners hand over "addr"
+			f, ok = inherited["addr"]
+		}
+
+		var ln httpproxy.Listener
+		if ok {
+			ln, err = httpproxy.FileListener(f, listenOpts)
+			f.Close()
+		} else {
+			ln, err = httpproxy.Listen(lc.Network, lc.Addr, listenOpts)
+		}
+		if err != nil {
+			glog.Fatalf("Listen(%s, %s, %#v) error: %s", lc.Network, lc.Addr, listenOpts, err)
+		}
 
-			rc := o.Body()
-			defer rc.Close()
+		h := httpproxy.NewHandler(ln, chain)
+		h.Name = lc.Name
+		h.Conns = conns
+		h.AccessLog = accessLog
 
-			b, err := ioutil.ReadAll(rc)
+		s := &http.Server{
+			Handler:        h,
+			ReadTimeout:    time.Duration(config.Http.ReadTimeout) * time.Second,
+			WriteTimeout:   time.Duration(config.Http.WriteTimeout) * time.Second,
+			MaxHeaderBytes: 1 << 20,
+		}
+
+		if lc.Ssl {
+			s.TLSConfig = listenOpts.TLSConfig
+			http2.ConfigureServer(s, &http2.Server{})
+		}
+
+		servers = append(servers, &server{ln, h, s})
+		handlers = append(handlers, h)
+	}
+
+	handlerOf := func(name string) *httpproxy.Handler {
+		if name == "" {
+			return handlers[0]
+		}
+		for _, h := range handlers {
+			if h.Name == name {
+				return h
+			}
+		}
+		glog.Fatalf("Listener %#v not found", name)
+		return nil
+	}
+
+	var ln1 net.Listener
+	if config.Socks.Addr != "" {
+		if f, ok := inherited["socks"]; ok {
+			ln1, err = net.FileListener(f)
+			f.Close()
+		} else {
+			ln1, err = net.Listen("tcp", config.Socks.Addr)
+		}
+		if err != nil {
+			glog.Fatalf("ListenTCP(%s) error: %s", config.Socks.Addr, err)
+		}
+		glog.Infof("ListenAndServe socks5 on %s\n", ln1.Addr().String())
+		go httpproxy.ServeSocks(ln1, handlerOf(config.Socks.Listener))
+	}
+
+	var ln2 net.Listener
+	if config.Redirect.Addr != "" {
+		if f, ok := inherited["redirect"]; ok {
+			ln2, err = net.FileListener(f)
+			f.Close()
+		} else {
+			ln2, err = net.Listen("tcp", config.Redirect.Addr)
+		}
+		if err != nil {
+			glog.Fatalf("ListenTCP(%s) error: %s", config.Redirect.Addr, err)
+		}
+		glog.Infof("ListenAndServe redirect on %s\n", ln2.Addr().String())
+		go httpproxy.ServeRedirect(ln2, handlerOf(config.Redirect.Listener))
+	}
+
+	var ln3 net.Listener
+	if config.Admin.Addr != "" {
+		if f, ok := inherited["admin"]; ok {
+			ln3, err = net.FileListener(f)
+			f.Close()
+		} else {
+			ln3, err = net.Listen("tcp", config.Admin.Addr)
+		}
+		if err != nil {
+			glog.Fatalf("ListenTCP(%s) error: %s", config.Admin.Addr, err)
+		}
+		if config.Admin.Password == "" {
+			glog.Warningf("Admin password is empty, only /metrics is served on %s", ln3.Addr().String())
+		}
+		glog.Infof("ListenAndServe admin on %s\n", ln3.Addr().String())
+		go http.Serve(ln3, httpproxy.NewAdmin(handlers, conns, config.Admin.Username, config.Admin.Password))
+	}
+
+	if err := filters.StartFilters(filtersCtx); err != nil {
+		glog.Fatalf("StartFilters() error: %s", err)
+	}
+
+	for _, srv := range servers {
+		glog.Infof("ListenAndServe %s on %s\n", srv.h.Name, srv.ln.Addr().String())
+		go srv.s.Serve(srv.ln)
+	}
+
+	if err := sdNotify("READY=1"); err != nil {
+		glog.Warningf("sdNotify(READY=1) error: %s", err)
+	}
+	if interval := sdWatchdog(); interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				sdNotify("WATCHDOG=1")
+			}
+		}()
+	}
+
+	signals := []os.Signal{syscall.SIGHUP}
+	if restartSignal != nil {
+		signals = append(signals, restartSignal)
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, signals...)
+	for sig := range c {
+		if sig != restartSignal {
+			glog.Infof("Receive %v, reload %#v and filters", sig, filename)
+			sdNotify("RELOADING=1")
+			if err := reload(filtersCtx, handlers, configUri, filename); err != nil {
+				glog.Errorf("reload(%#v) error: %s", filename, err)
+			}
+			sdNotify("READY=1")
+			continue
+		}
+
+		glog.Infof("Receive %v, restart goproxy gracefully", sig)
+		files := make(map[string]*os.File)
+		for _, srv := range servers {
+			f, err := srv.ln.File()
 			if err != nil {
-				glog.Fatalf("ioutil.ReadAll error: %s", err)
+				glog.Errorf("%T.File() of listener %#v error: %s", srv.ln, srv.h.Name, err)
+				break
+			}
+			files["addr:"+srv.h.Name] = f
+		}
+		if len(files) != len(servers) {
+			for _, f := range files {
+				f.Close()
+			}
+			continue
+		}
+		for name, ln := range map[string]net.Listener{"groupcache": ln0, "socks": ln1, "redirect": ln2, "admin": ln3} {
+			if ln == nil {
+				continue
+			}
+			fl, ok := ln.(interface {
+				File() (*os.File, error)
+			})
+			if !ok {
+				glog.Warningf("%T of %#v cannot be passed to the new process", ln, name)
+				continue
+			}
+			if f, err := fl.File(); err == nil {
+				files[name] = f
+			} else {
+				glog.Errorf("%T.File() of %#v error: %s", ln, name, err)
 			}
-			return b
 		}
 
-		certPem := readPem(config.Http.Certificate)
-		keyPem := readPem(config.Http.Certificate)
-		tlsCert, err := tls.X509KeyPair(certPem, keyPem)
+		p, err := startProcess(files)
+		for _, f := range files {
+			f.Close()
+		}
 		if err != nil {
-			glog.Fatalf("tls.X509KeyPair error: %s", err)
+			glog.Errorf("startProcess() error: %s", err)
+			continue
+		}
+
+		var active int64
+		for _, h := range handlers {
+			active += h.Active()
 		}
+		glog.Infof("New goproxy process(%d) started, draining %d requests", p.Pid, active)
+		sdNotify(fmt.Sprintf("MAINPID=%d", p.Pid))
+		shutdown(servers, time.Duration(config.GracefulTimeout)*time.Second, ln0, ln1, ln2, ln3)
+		return
+	}
+}
+
+// shutdown stops accepting and waits for active requests and tunnels to finish.
+func shutdown(servers []*server, timeout time.Duration, lns ...net.Listener) {
+	if timeout <= 0 {
+		timeout = defaultGracefulTimeout
+	}
 
-		tlsConfig = &tls.Config{
-			Certificates: []tls.Certificate{tlsCert},
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, ln := range lns {
+		if ln != nil {
+			ln.Close()
 		}
 	}
+	for _, srv := range servers {
+		srv.ln.Close()
+	}
 
-	listenOpts := &httpproxy.ListenOptions{TLSConfig: tlsConfig}
+	for _, srv := range servers {
+		if err := srv.s.Shutdown(ctx); err != nil {
+			glog.Warningf("%T.Shutdown() of listener %#v error: %s", srv.s, srv.h.Name, err)
+		}
+	}
+
+	for _, srv := range servers {
+		if err := srv.h.Wait(ctx); err != nil {
+			glog.Warningf("Drain requests of listener %#v error: %s, %d requests dropped", srv.h.Name, err, srv.h.Active())
+		}
+	}
+
+	if err := filters.CloseFilters(ctx, filters.Filters()); err != nil {
+		glog.Warningf("CloseFilters() error: %s", err)
+	}
+
+	glog.Flush()
+}
+
+// reload re-reads the config and swaps fresh filter chains into the handlers,
+// listeners are only added or removed by a restart. The fresh filters are
+// started with ctx and the old ones are closed.
+func reload(ctx context.Context, handlers []*httpproxy.Handler, configUri, filename string) error {
+	config := new(Config)
+	err := storage.ReadJsonConfig(configUri, filename, config)
+	if err != nil {
+		return err
+	}
 
-	ln, err := httpproxy.ListenTCP("tcp", config.Addr, listenOpts)
+	lcs, err := config.listeners()
 	if err != nil {
-		glog.Fatalf("ListenTCP(%s, %#v) error: %s", config.Addr, listenOpts, err)
+		return err
 	}
 
-	h := httpproxy.Handler{
-		Listener:         ln,
-		RequestFilters:   requestFilters,
-		RoundTripFilters: roundtripFilters,
-		ResponseFilters:  responseFilters,
+	filters.BeginFilters()
+	chains := make([]*httpproxy.Chain, len(handlers))
+	keep := make([]string, 0)
+	for i, h := range handlers {
+		for _, lc := range lcs {
+			if lc.Name == h.Name {
+				if chains[i], err = getFilters(&lc.Filters); err != nil {
+					abortFilters(ctx)
+					return fmt.Errorf("listener %#v: %s", lc.Name, err)
+				}
+				glog.Infof("Reload listener %#v filters %v|%v|%v OK", lc.Name, lc.Filters.Request, lc.Filters.RoundTrip, lc.Filters.Response)
+			}
+		}
+		if chains[i] == nil {
+			glog.Warningf("Listener %#v is removed from %#v, keep its filters until restart", h.Name, filename)
+			for name := range h.Chain().Filters {
+				keep = append(keep, name)
+			}
+		}
 	}
 
-	s := &http.Server{
-		Handler:        h,
-		ReadTimeout:    time.Duration(config.Http.ReadTimeout) * time.Second,
-		WriteTimeout:   time.Duration(config.Http.WriteTimeout) * time.Second,
-		MaxHeaderBytes: 1 << 20,
+	if err := filters.StartFilters(ctx); err != nil {
+		abortFilters(ctx)
+		return err
 	}
 
-	if config.Http.Ssl {
-		s.TLSConfig = tlsConfig
-		http2.ConfigureServer(s, &http2.Server{})
+	old := filters.CommitFilters(keep)
+	for i, h := range handlers {
+		if chains[i] != nil {
+			h.SetChain(chains[i])
+		}
 	}
 
-	glog.Infof("ListenAndServe on %s\n", h.Listener.Addr().String())
-	s.Serve(h.Listener)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return filters.CloseFilters(ctx, old)
+}
+
+// abortFilters closes the filters created by a failed reload
+func abortFilters(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := filters.CloseFilters(ctx, filters.AbortFilters()); err != nil {
+		glog.Warningf("CloseFilters() error: %s", err)
+	}
 }
 
-func getFilters(config *Config) ([]filters.RequestFilter, []filters.RoundTripFilter, []filters.ResponseFilter) {
+func getFilters(config *FiltersConfig) (*httpproxy.Chain, error) {
+
+	groups := [][]string{config.Request,
+		config.Middleware,
+		config.RoundTrip,
+		config.Response}
+	for _, r := range config.Routes {
+		groups = append(groups, r.Middleware, r.Response)
+	}
 
 	fs := make(map[string]filters.Filter)
-	for _, names := range [][]string{config.Filters.Request,
-		config.Filters.RoundTrip,
-		config.Filters.Response} {
+	for _, names := range groups {
 		for _, name := range names {
 			if _, ok := fs[name]; !ok {
 				f, err := filters.GetFilter(name)
 				if err != nil {
-					glog.Fatalf("filters.GetFilter(%#v) failed: %#v", name, err)
+					return nil, fmt.Errorf("filters.GetFilter(%#v) failed: %s", name, err)
 				}
 				fs[name] = f
 			}
 		}
 	}
 
-	requestFilters := make([]filters.RequestFilter, 0)
-	for _, name := range config.Filters.Request {
+	chain := &httpproxy.Chain{Filters: fs}
+
+	for _, name := range config.Request {
 		f := fs[name]
 		f1, ok := f.(filters.RequestFilter)
 		if !ok {
-			glog.Fatalf("%#v is not a RequestFilter", f)
+			return nil, fmt.Errorf("%#v is not a RequestFilter", f)
+		}
+		chain.RequestFilters = append(chain.RequestFilters, f1)
+	}
+
+	for _, name := range config.Middleware {
+		f, err := filters.Middleware(fs[name])
+		if err != nil {
+			return nil, err
 		}
-		requestFilters = append(requestFilters, f1)
+		chain.Middlewares = append(chain.Middlewares, f)
 	}
 
-	roundtripFilters := make([]filters.RoundTripFilter, 0)
-	for _, name := range config.Filters.RoundTrip {
+	for _, name := range config.RoundTrip {
 		f := fs[name]
 		f1, ok := f.(filters.RoundTripFilter)
 		if !ok {
-			glog.Fatalf("%#v is not a RoundTripFilter", f)
+			return nil, fmt.Errorf("%#v is not a RoundTripFilter", f)
 		}
-		roundtripFilters = append(roundtripFilters, f1)
+		chain.RoundTripFilters = append(chain.RoundTripFilters, f1)
 	}
 
-	responseFilters := make([]filters.ResponseFilter, 0)
-	for _, name := range config.Filters.Response {
+	for _, name := range config.Response {
 		f := fs[name]
 		f1, ok := f.(filters.ResponseFilter)
 		if !ok {
-			glog.Fatalf("%#v is not a ResponseFilter", f)
+			return nil, fmt.Errorf("%#v is not a ResponseFilter", f)
+		}
+		chain.ResponseFilters = append(chain.ResponseFilters, f1)
+	}
+
+	if len(config.Routes) > 0 {
+		rules := make([]*httpproxy.Rule, 0)
+		for i, r := range config.Routes {
+			f, ok := fs[r.Filter]
+			if !ok || !contains(config.RoundTrip, r.Filter) {
+				return nil, fmt.Errorf("route %d filter %#v is not in RoundTrip filters", i, r.Filter)
+			}
+
+			rule := &httpproxy.Rule{
+				Name:    r.Name,
+				Ports:   make(map[string]struct{}),
+				Methods: make(map[string]struct{}),
+				Paths:   r.Paths,
+				Sources: make([]*net.IPNet, 0),
+				Users:   make(map[string]struct{}),
+				Filter:  f.(filters.RoundTripFilter),
+			}
+			if rule.Name == "" {
+				rule.Name = fmt.Sprintf("#%d", i)
+			}
+			if len(r.Hosts) > 0 {
+				rule.Hosts = httpproxy.NewHostMatcher(r.Hosts)
+			}
+			for _, port := range r.Ports {
+				rule.Ports[strconv.Itoa(port)] = struct{}{}
+			}
+			for _, method := range r.Methods {
+				rule.Methods[strings.ToUpper(method)] = struct{}{}
+			}
+			for _, source := range r.Sources {
+				ipnet, err := parseIPNet(source)
+				if err != nil {
+					return nil, fmt.Errorf("route %d source %#v error: %s", i, source, err)
+				}
+				rule.Sources = append(rule.Sources, ipnet)
+			}
+			for _, user := range r.Users {
+				rule.Users[user] = struct{}{}
+			}
+			for _, name := range r.Middleware {
+				f, err := filters.Middleware(fs[name])
+				if err != nil {
+					return nil, fmt.Errorf("route %d middleware: %s", i, err)
+				}
+				rule.Middlewares = append(rule.Middlewares, f)
+			}
+			for _, name := range r.Response {
+				f, ok := fs[name].(filters.ResponseFilter)
+				if !ok {
+					return nil, fmt.Errorf("route %d: %#v is not a ResponseFilter", i, fs[name])
+				}
+				rule.ResponseFilters = append(rule.ResponseFilters, f)
+			}
+
+			rules = append(rules, rule)
+		}
+		chain.Router = httpproxy.NewRouter(rules)
+	}
+
+	if len(config.Timeouts) > 0 {
+		chain.Timeouts = make(map[filters.Filter]time.Duration)
+		for name, timeout := range config.Timeouts {
+			f, ok := fs[name]
+			if !ok || !contains(config.RoundTrip, name) {
+				return nil, fmt.Errorf("timeout filter %#v is not in RoundTrip filters", name)
+			}
+			chain.Timeouts[f] = time.Duration(timeout) * time.Second
+		}
+	}
+
+	if config.Failover.Enabled {
+		chain.Failover = httpproxy.NewFailover(config.Failover.StatusCodes, config.Failover.MaxBodySize)
+	}
+
+	return chain, nil
+}
+
+// readTLSConfig reads the certificate and private key pem objects from the
+// config store.
+func readTLSConfig(configUri, certificate, privateKey string) *tls.Config {
+	readPem := func(object string) []byte {
+		store, err := storage.OpenURI(configUri)
+		if err != nil {
+			glog.Fatalf("store.OpenURI(%v) error: %s", configUri, err)
+		}
+
+		o, err := store.GetObject(object, -1, -1)
+		if err != nil {
+			glog.Fatalf("store.GetObject(%v) error: %s", object, err)
+		}
+
+		rc := o.Body()
+		defer rc.Close()
+
+		b, err := ioutil.ReadAll(rc)
+		if err != nil {
+			glog.Fatalf("ioutil.ReadAll error: %s", err)
 		}
-		responseFilters = append(responseFilters, f1)
+		return b
 	}
 
-	return requestFilters, roundtripFilters, responseFilters
+	tlsCert, err := tls.X509KeyPair(readPem(certificate), readPem(privateKey))
+	if err != nil {
+		glog.Fatalf("tls.X509KeyPair error: %s", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{tlsCert},
+	}
+}
+
+func contains(names []string, name string) bool {
+	for _, s := range names {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIPNet parses a CIDR or a single IP address.
+func parseIPNet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		if strings.Contains(s, ":") {
+			s += "/128"
+		} else {
+			s += "/32"
+		}
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	return ipnet, err
 }
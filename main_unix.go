@@ -0,0 +1,156 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	envListenFiles = "GOPROXY_LISTEN_FILES"
+)
+
+// services with their own listening socket, other systemd socket names are
+// taken as the names of http listeners
+var inheritedServices = map[string]bool{
+	"groupcache": true,
+	"socks":      true,
+	"redirect":   true,
+	"admin":      true,
+}
+
+var (
+	restartSignal os.Signal = syscall.SIGUSR2
+)
+
+// inheritedFiles returns the listening sockets handed over by the parent process,
+// or passed by systemd socket activation.
+func inheritedFiles() map[string]*os.File {
+	files := make(map[string]*os.File)
+
+	names := os.Getenv(envListenFiles)
+	if names == "" {
+		return systemdFiles()
+	}
+	os.Unsetenv(envListenFiles)
+
+	for i, name := range strings.Split(names, ",") {
+		files[name] = os.NewFile(uintptr(3+i), name)
+	}
+
+	return files
+}
+
+// startProcess re-executes goproxy and passes the listening sockets to it.
+func startProcess(files map[string]*os.File) (*os.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	fds := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	for name, f := range files {
+		names = append(names, name)
+		fds = append(fds, f)
+	}
+
+	env := make([]string, 0)
+	for _, s := range os.Environ() {
+		// the new process becomes the MAINPID and pings the systemd watchdog
+		if !strings.HasPrefix(s, envListenFiles+"=") && !strings.HasPrefix(s, "WATCHDOG_PID=") {
+			env = append(env, s)
+		}
+	}
+	env = append(env, envListenFiles+"="+strings.Join(names, ","))
+
+	return os.StartProcess(exe, os.Args, &os.ProcAttr{
+		Dir:   wd,
+		Env:   env,
+		Files: fds,
+	})
+}
+
+// systemdFiles returns the sockets of systemd socket activation by their
+// FileDescriptorName, see sd_listen_fds(3).
+func systemdFiles() map[string]*os.File {
+	files := make(map[string]*os.File)
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return files
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return files
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for _, key := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(key)
+	}
+
+	for i := 0; i < n; i++ {
+		fd := 3 + i
+		syscall.CloseOnExec(fd)
+
+		name := "default"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		if !inheritedServices[name] {
+			name = "addr:" + name
+		}
+		if _, ok := files[name]; ok {
+			continue
+		}
+		files[name] = os.NewFile(uintptr(fd), name)
+	}
+
+	return files
+}
+
+// sdNotify sends state to the systemd service manager, it does nothing if
+// goproxy is not started by systemd, see sd_notify(3).
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdog returns the interval of systemd watchdog pings, zero if the
+// watchdog is disabled.
+func sdWatchdog() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond / 2
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+)
+
+var (
+	restartSignal os.Signal = nil
+)
+
+func inheritedFiles() map[string]*os.File {
+	return make(map[string]*os.File)
+}
+
+func startProcess(files map[string]*os.File) (*os.Process, error) {
+	return nil, fmt.Errorf("graceful restart is not supported on %s", runtime.GOOS)
+}
+
+func sdNotify(state string) error {
+	return nil
+}
+
+func sdWatchdog() time.Duration {
+	return 0
+}